@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+type adminCacheEntry struct {
+	Name    string   `json:"name"`
+	Type    string   `json:"type"`
+	TTL     uint32   `json:"ttl"` // seconds left, 0 once expired
+	Source  string   `json:"source,omitempty"`
+	Rcode   string   `json:"rcode"`
+	Records []string `json:"records"`
+}
+
+// serveCache handles GET /cache, listing the records in the memory cache.
+// With the bolt backend that is only the records queried since startup.
+func (h *dnsHandler) serveCache(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	entries := []adminCacheEntry{}
+	records.each(func(key cacheKey, rec record) {
+		e := adminCacheEntry{
+			Name:    key.name,
+			Type:    dns.TypeToString[key.qtype],
+			TTL:     rec.remainingTTL(now, h.defaultTTL),
+			Source:  rec.source,
+			Rcode:   dns.RcodeToString[dns.RcodeSuccess],
+			Records: []string{},
+		}
+		if rec.servfail {
+			e.Rcode = dns.RcodeToString[dns.RcodeServerFailure]
+		}
+		for _, rr := range rec.rrs {
+			e.Records = append(e.Records, strings.TrimPrefix(rr.String(), rr.Header().String()))
+		}
+		entries = append(entries, e)
+	})
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Name != entries[j].Name {
+			return entries[i].Name < entries[j].Name
+		}
+		return entries[i].Type < entries[j].Type
+	})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
+
+// exportWriteTimeout bounds every write of /cache/export, which holds a
+// shard lock of the cache, or a read transaction of the database, while
+// writing.
+const exportWriteTimeout = 10 * time.Second
+
+// serveCacheExport handles GET /cache/export, streaming the live records of
+// the cache, read from the database when there is one, in the format of the
+// cache file, for POST /cache/import of another instance to start warm
+// from.
+func (h *dnsHandler) serveCacheExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	now := time.Now()
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	bw := bufio.NewWriter(&deadlineWriter{w: w, rc: http.NewResponseController(w)})
+	var err error
+	write := func(key cacheKey, rec record) {
+		if err != nil || rec.servfail || rec.expired(now) {
+			return
+		}
+		_, err = fmt.Fprintf(bw, "%s %s\n", key.name, formatRecord(key.qtype, rec))
+	}
+	if disk != nil {
+		disk.each(write)
+	} else {
+		records.each(write)
+	}
+	if err == nil {
+		bw.Flush()
+	}
+}
+
+// deadlineWriter gives every write to the client of w a deadline of its
+// own, so that a stalled client fails the export instead of holding up the
+// cache.
+type deadlineWriter struct {
+	w  http.ResponseWriter
+	rc *http.ResponseController
+}
+
+func (d *deadlineWriter) Write(p []byte) (int, error) {
+	d.rc.SetWriteDeadline(time.Now().Add(exportWriteTimeout))
+	return d.w.Write(p)
+}
+
+// serveCacheImport handles POST /cache/import, adding the records of an
+// export to the cache as they are read. Expired ones are skipped.
+func (h *dnsHandler) serveCacheImport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	now := time.Now()
+	imported, skipped := 0, 0
+	err := readCacheLines(r.Body, func(key cacheKey, rec record) {
+		if rec.expired(now) {
+			skipped++
+			return
+		}
+		if disk == nil || records.bounded() {
+			records.set(key, rec)
+		}
+		if disk != nil {
+			if err := disk.put(key, rec); err != nil {
+				log.Printf("Failed to write %s to the cache database: %s", key.name, err)
+			}
+		}
+		imported++
+	})
+	if imported > 0 && disk == nil && h.cachePath != "" {
+		if h.cacheFlushInterval > 0 {
+			cacheDirty.Store(true)
+		} else {
+			saveCache(h.cachePath)
+		}
+	}
+	log.Printf("Imported %d cached records, skipped %d expired", imported, skipped)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"imported": imported, "skipped": skipped})
+}
+
+// serveLogLevel handles GET /log-level, and POST /log-level?level=debug
+// changing it until the next change or restart.
+func serveLogLevel(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		level, err := parseLogLevel(r.FormValue("level"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		setLogLevel(level)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"level": logLevelName()})
+}
+
+func (h *dnsHandler) serveAdmin(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/cache", h.serveCache)
+	mux.HandleFunc("/cache/export", h.serveCacheExport)
+	mux.HandleFunc("/cache/import", h.serveCacheImport)
+	mux.HandleFunc("/log-level", serveLogLevel)
+	serveHTTP("the admin API", addr, mux)
+}
+
+// serveHTTP serves one of the HTTP APIs next to DNS. Failing to, like when
+// the port is taken, is logged rather than fatal so that DNS keeps being
+// served.
+func serveHTTP(what, addr string, handler http.Handler) {
+	log.Printf("Serving %s at %s\n", what, addr)
+	if err := http.ListenAndServe(addr, handler); err != nil {
+		log.Printf("Failed to serve %s at %s, going on without it: %s", what, addr, err)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// runBench implements the "bench" subcommand, a load generator firing
+// queries for the names of a domain list at a fixed rate.
+func runBench(args []string) {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	target := fs.String("target", "127.0.0.1:5353", "Address of the resolver under test")
+	domainsPath := fs.String("domains", "", "The file path to the domains to query, one per line")
+	qps := fs.Int("qps", 100, "queries per second")
+	duration := fs.Duration("duration", 10*time.Second, "how long to generate load")
+	qtype := fs.String("type", "A", "query type")
+	timeout := fs.Duration("timeout", 2*time.Second, "timeout of a single query")
+	fs.Parse(args)
+
+	if *domainsPath == "" || *qps <= 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	t, ok := dns.StringToType[strings.ToUpper(*qtype)]
+	if !ok {
+		log.Fatalf("Unknown query type: %s", *qtype)
+	}
+	domains, err := readDomainList(*domainsPath)
+	if err != nil {
+		log.Fatal("Failed to read domains file: ", err)
+	}
+	if len(domains) == 0 {
+		log.Fatal("No domains to query")
+	}
+
+	c := &dns.Client{Timeout: *timeout}
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var rtts []time.Duration
+	failed := 0
+
+	ticker := time.NewTicker(time.Second / time.Duration(*qps))
+	defer ticker.Stop()
+	deadline := time.Now().Add(*duration)
+	for i := 0; time.Now().Before(deadline); i++ {
+		<-ticker.C
+		m := new(dns.Msg)
+		m.SetQuestion(dns.Fqdn(domains[i%len(domains)]), t)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r, rtt, err := c.Exchange(m, *target)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil || r.Rcode == dns.RcodeServerFailure {
+				failed++
+				return
+			}
+			rtts = append(rtts, rtt)
+		}()
+	}
+	wg.Wait()
+
+	total := len(rtts) + failed
+	fmt.Printf("queries: %d, errors: %d (%.2f%%)\n", total, failed, 100*float64(failed)/float64(total))
+	if len(rtts) == 0 {
+		return
+	}
+	sort.Slice(rtts, func(i, j int) bool { return rtts[i] < rtts[j] })
+	percentile := func(p float64) time.Duration {
+		return rtts[int(p*float64(len(rtts)-1))]
+	}
+	fmt.Printf("latency p50: %s, p90: %s, p99: %s, max: %s\n", percentile(0.5), percentile(0.9), percentile(0.99), rtts[len(rtts)-1])
+}
+
+// readDomainList reads one domain per line, skipping blank lines and
+// comments, from stdin if path is "-".
+func readDomainList(path string) ([]string, error) {
+	file := os.Stdin
+	if path != "-" {
+		var err error
+		if file, err = os.Open(path); err != nil {
+			return nil, err
+		}
+		defer file.Close()
+	}
+	var domains []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		domains = append(domains, line)
+	}
+	return domains, scanner.Err()
+}
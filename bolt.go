@@ -0,0 +1,86 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	bolt "go.etcd.io/bbolt"
+)
+
+var recordsBucket = []byte("records")
+
+// disk is the optional on-disk cache backing the records map. When set,
+// records are read from it on a memory miss and written to it on update.
+var disk *boltStore
+
+type boltStore struct {
+	db *bolt.DB
+}
+
+func openBoltStore(path string) (*boltStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(recordsBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &boltStore{db: db}, nil
+}
+
+// boltKey keys A records by their name alone, as in the cache file.
+func boltKey(key cacheKey) []byte {
+	if key.qtype == dns.TypeA {
+		return []byte(key.name)
+	}
+	return []byte(key.name + " " + dns.TypeToString[key.qtype])
+}
+
+// get returns the record of key. Values use the same encoding as the
+// fields of a cache file line.
+func (s *boltStore) get(key cacheKey) (record, bool) {
+	var value string
+	s.db.View(func(tx *bolt.Tx) error {
+		value = string(tx.Bucket(recordsBucket).Get(boltKey(key)))
+		return nil
+	})
+	if value == "" {
+		return record{}, false
+	}
+	_, rec, err := parseRecord(key.name, strings.Split(value, " "))
+	if err != nil {
+		return record{}, false
+	}
+	return rec, true
+}
+
+// each calls fn for every record of the database, within one read
+// transaction.
+func (s *boltStore) each(fn func(cacheKey, record)) {
+	s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(recordsBucket).ForEach(func(k, v []byte) error {
+			name, _, _ := strings.Cut(string(k), " ")
+			qtype, rec, err := parseRecord(name, strings.Split(string(v), " "))
+			if err == nil {
+				fn(cacheKey{name, qtype}, rec)
+			}
+			return nil
+		})
+	})
+}
+
+func (s *boltStore) put(key cacheKey, rec record) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(recordsBucket).Put(boltKey(key), []byte(formatRecord(key.qtype, rec)))
+	})
+}
+
+func (s *boltStore) close() error {
+	return s.db.Close()
+}
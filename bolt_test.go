@@ -0,0 +1,65 @@
+package main
+
+import (
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// useBoltStore makes the cache a database at a temporary path for the rest
+// of the test, with the memory cache of the other tests left unbounded.
+func useBoltStore(t *testing.T) {
+	waitForCacheWrites()
+	store, err := openBoltStore(filepath.Join(t.TempDir(), "cache.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	disk = store
+	t.Cleanup(func() {
+		waitForCacheWrites()
+		disk = nil
+		store.close()
+	})
+}
+
+func TestBoltServfailDoesNotShadowRecords(t *testing.T) {
+	useBoltStore(t)
+	var failing atomic.Bool
+	var queries atomic.Int32
+	failing.Store(true)
+	addr := startUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		queries.Add(1)
+		m := new(dns.Msg)
+		m.SetReply(r)
+		if failing.Load() {
+			m.Rcode = dns.RcodeServerFailure
+		} else {
+			rr, _ := dns.NewRR(r.Question[0].Name + " 300 IN A 192.0.2.1")
+			m.Answer = append(m.Answer, rr)
+		}
+		w.WriteMsg(m)
+	})
+	h := newTestHandler(addr)
+	h.servfailTTL = time.Minute
+	name := testName("flaky")
+	if m := query(h, name, dns.TypeA); m.Rcode != dns.RcodeServerFailure {
+		t.Fatalf("rcode %s while the upstream fails, want SERVFAIL", dns.RcodeToString[m.Rcode])
+	}
+	failing.Store(false)
+	if m := query(h, name, dns.TypeA); len(m.Answer) != 1 {
+		t.Fatalf("answered %s %v once the upstream recovered", dns.RcodeToString[m.Rcode], m.Answer)
+	}
+	waitForCacheWrites()
+	if m := query(h, name, dns.TypeA); len(m.Answer) != 1 {
+		t.Fatalf("answered %s %v from the database", dns.RcodeToString[m.Rcode], m.Answer)
+	}
+	if n := queries.Load(); n != 2 {
+		t.Errorf("%d upstream queries, want 2", n)
+	}
+	if cached(records, name) {
+		t.Errorf("%s kept in the unbounded memory cache", name)
+	}
+}
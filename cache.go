@@ -0,0 +1,195 @@
+package main
+
+import (
+	"container/list"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// sweepInterval is how often a full shard may be scanned for expired
+// records. Scanning is linear in the shard size, so a shard holding only
+// fresh records falls back to plain LRU eviction in between.
+const sweepInterval = time.Second
+
+// recordCache is the in-memory record store. It is split into shards, each
+// guarded by its own lock, so that concurrent queries for different names
+// rarely contend. When bounded, a full shard evicts expired records first
+// and otherwise the least recently used one.
+type recordCache struct {
+	shards    []*cacheShard
+	evictions atomic.Uint64
+	// keep records in wire form, set before the cache is used
+	compressed bool
+}
+
+type cacheShard struct {
+	sync.Mutex
+	records map[cacheKey]*list.Element // of *cacheEntry
+	lru     *list.List                 // most recently used first
+	size    int                        // 0 means unbounded
+	swept   time.Time
+}
+
+type cacheEntry struct {
+	key    cacheKey
+	rec    record
+	packed []byte // the records of rec in wire form when compressed
+}
+
+// newRecordCache returns a cache holding at most size records, split evenly
+// between the shards, or any number of them if size is 0.
+func newRecordCache(shards, size int) *recordCache {
+	if shards < 1 {
+		shards = 1
+	}
+	perShard := 0
+	if size > 0 {
+		perShard = (size + shards - 1) / shards
+	}
+	c := &recordCache{shards: make([]*cacheShard, shards)}
+	for i := range c.shards {
+		c.shards[i] = &cacheShard{records: make(map[cacheKey]*list.Element), lru: list.New(), size: perShard}
+	}
+	return c
+}
+
+// bounded reports whether the cache holds a limited number of records.
+func (c *recordCache) bounded() bool {
+	return c.shards[0].size > 0
+}
+
+func (c *recordCache) shard(name string) *cacheShard {
+	if len(c.shards) == 1 {
+		return c.shards[0]
+	}
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	return c.shards[h.Sum32()%uint32(len(c.shards))]
+}
+
+func (c *recordCache) get(key cacheKey) (record, bool) {
+	s := c.shard(key.name)
+	s.Lock()
+	e, ok := s.records[key]
+	if !ok {
+		s.Unlock()
+		return record{}, false
+	}
+	s.lru.MoveToFront(e)
+	entry := *e.Value.(*cacheEntry)
+	s.Unlock()
+	// unpacked outside of the lock
+	return entry.unpacked()
+}
+
+func (c *recordCache) set(key cacheKey, rec record) {
+	entry := cacheEntry{key: key, rec: rec}
+	if c.compressed && len(rec.rrs) > 0 {
+		if wire, err := (&dns.Msg{Answer: rec.rrs, Compress: true}).Pack(); err == nil {
+			entry.rec.rrs, entry.packed = nil, wire
+		}
+	}
+	s := c.shard(key.name)
+	s.Lock()
+	defer s.Unlock()
+	if e, ok := s.records[key]; ok {
+		*e.Value.(*cacheEntry) = entry
+		s.lru.MoveToFront(e)
+		return
+	}
+	if s.size > 0 && len(s.records) >= s.size {
+		c.evictions.Add(uint64(s.evict(time.Now())))
+	}
+	s.records[key] = s.lru.PushFront(&entry)
+}
+
+// unpacked returns the record of e, parsing its records back from wire
+// form when compressed. Records that fail to parse count as missing.
+func (e cacheEntry) unpacked() (record, bool) {
+	if e.packed == nil {
+		return e.rec, true
+	}
+	m := new(dns.Msg)
+	if err := m.Unpack(e.packed); err != nil {
+		return record{}, false
+	}
+	rec := e.rec
+	rec.rrs = m.Answer
+	return rec, true
+}
+
+// evict makes room for one record and returns how many were removed: every
+// expired record if the shard was not swept recently and holds any, else
+// the least recently used one.
+func (s *cacheShard) evict(now time.Time) int {
+	if now.Sub(s.swept) >= sweepInterval {
+		s.swept = now
+		removed := 0
+		for e := s.lru.Back(); e != nil; {
+			prev := e.Prev()
+			if e.Value.(*cacheEntry).rec.expired(now) {
+				s.remove(e)
+				removed++
+			}
+			e = prev
+		}
+		if removed > 0 {
+			return removed
+		}
+	}
+	s.remove(s.lru.Back())
+	return 1
+}
+
+func (s *cacheShard) remove(e *list.Element) {
+	delete(s.records, e.Value.(*cacheEntry).key)
+	s.lru.Remove(e)
+}
+
+func (c *recordCache) len() int {
+	n := 0
+	for _, s := range c.shards {
+		s.Lock()
+		n += len(s.records)
+		s.Unlock()
+	}
+	return n
+}
+
+// snapshot returns a copy of every cached record, holding the lock of one
+// shard at a time.
+func (c *recordCache) snapshot() []cacheEntry {
+	var entries []cacheEntry
+	for _, s := range c.shards {
+		s.Lock()
+		for e := s.lru.Front(); e != nil; e = e.Next() {
+			entries = append(entries, *e.Value.(*cacheEntry))
+		}
+		s.Unlock()
+	}
+	kept := entries[:0]
+	for _, e := range entries {
+		if rec, ok := e.unpacked(); ok {
+			kept = append(kept, cacheEntry{key: e.key, rec: rec})
+		}
+	}
+	return kept
+}
+
+// each calls fn for every cached record, holding the lock of one shard at a
+// time.
+func (c *recordCache) each(fn func(cacheKey, record)) {
+	for _, s := range c.shards {
+		s.Lock()
+		for key, e := range s.records {
+			if rec, ok := e.Value.(*cacheEntry).unpacked(); ok {
+				fn(key, rec)
+			}
+		}
+		s.Unlock()
+	}
+}
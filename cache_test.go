@@ -0,0 +1,308 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// testRecord returns an A record of name expiring at expiry.
+func testRecord(t testing.TB, name string, expiry time.Time) record {
+	rr, err := dns.NewRR(name + " 300 IN A 192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return record{rrs: []dns.RR{rr}, expiry: expiry}
+}
+
+func keyOf(name string) cacheKey {
+	return cacheKey{name, dns.TypeA}
+}
+
+func cached(c *recordCache, name string) bool {
+	_, ok := c.get(keyOf(name))
+	return ok
+}
+
+func TestCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c := newRecordCache(1, 3)
+	fresh := time.Now().Add(time.Hour)
+	for _, name := range []string{"a.", "b.", "c."} {
+		c.set(keyOf(name), testRecord(t, name, fresh))
+	}
+	c.get(keyOf("a."))
+	c.set(keyOf("d."), testRecord(t, "d.", fresh))
+	if cached(c, "b.") {
+		t.Error("b. was not evicted as the least recently used")
+	}
+	for _, name := range []string{"a.", "c.", "d."} {
+		if !cached(c, name) {
+			t.Errorf("%s was evicted", name)
+		}
+	}
+	if n := c.evictions.Load(); n != 1 {
+		t.Errorf("%d evictions, want 1", n)
+	}
+}
+
+func TestCacheEvictsExpiredFirst(t *testing.T) {
+	c := newRecordCache(1, 4)
+	fresh := time.Now().Add(time.Hour)
+	stale := time.Now().Add(-time.Minute)
+	c.set(keyOf("old1."), testRecord(t, "old1.", stale))
+	c.set(keyOf("a."), testRecord(t, "a.", fresh))
+	c.set(keyOf("old2."), testRecord(t, "old2.", stale))
+	c.set(keyOf("b."), testRecord(t, "b.", fresh))
+	// the expired records are the most recently used, they go anyway
+	c.get(keyOf("old1."))
+	c.get(keyOf("old2."))
+	c.set(keyOf("c."), testRecord(t, "c.", fresh))
+	for _, name := range []string{"old1.", "old2."} {
+		if cached(c, name) {
+			t.Errorf("expired %s was not evicted", name)
+		}
+	}
+	for _, name := range []string{"a.", "b.", "c."} {
+		if !cached(c, name) {
+			t.Errorf("%s was evicted", name)
+		}
+	}
+	if n := c.evictions.Load(); n != 2 {
+		t.Errorf("%d evictions, want 2", n)
+	}
+}
+
+func TestCacheSweepsOncePerInterval(t *testing.T) {
+	s := newRecordCache(1, 0).shards[0]
+	now := time.Now()
+	for i, expiry := range []time.Time{now.Add(time.Hour), now.Add(-time.Minute), now.Add(time.Hour)} {
+		name := fmt.Sprintf("n%d.", i)
+		s.records[keyOf(name)] = s.lru.PushFront(&cacheEntry{key: keyOf(name), rec: testRecord(t, name, expiry)})
+	}
+	s.swept = now
+	// swept just now, so the least recently used goes although a record
+	// expired
+	if n := s.evict(now.Add(sweepInterval / 2)); n != 1 {
+		t.Fatalf("evicted %d, want 1", n)
+	}
+	if _, ok := s.records[keyOf("n0.")]; ok {
+		t.Error("the least recently used n0. was not evicted")
+	}
+	if n := s.evict(now.Add(sweepInterval)); n != 1 {
+		t.Fatalf("evicted %d, want 1", n)
+	}
+	if _, ok := s.records[keyOf("n1.")]; ok {
+		t.Error("the expired n1. was not swept")
+	}
+	if _, ok := s.records[keyOf("n2.")]; !ok {
+		t.Error("n2. was evicted")
+	}
+}
+
+func TestCacheEvictsPerShard(t *testing.T) {
+	c := newRecordCache(2, 4)
+	// names of each shard, in the order they are filled
+	byShard := make(map[*cacheShard][]string)
+	for i := 0; len(byShard[c.shards[0]]) < 3 || len(byShard[c.shards[1]]) < 3; i++ {
+		name := fmt.Sprintf("n%d.", i)
+		s := c.shard(name)
+		byShard[s] = append(byShard[s], name)
+	}
+	fresh := time.Now().Add(time.Hour)
+	first, second := byShard[c.shards[0]], byShard[c.shards[1]]
+	for _, name := range second[:2] {
+		c.set(keyOf(name), testRecord(t, name, fresh))
+	}
+	// filling the first shard past its 2 records leaves the second alone
+	for _, name := range first {
+		c.set(keyOf(name), testRecord(t, name, fresh))
+	}
+	if cached(c, first[0]) {
+		t.Errorf("%s was not evicted from its full shard", first[0])
+	}
+	for _, name := range append(first[1:], second[:2]...) {
+		if !cached(c, name) {
+			t.Errorf("%s was evicted", name)
+		}
+	}
+	if n := c.len(); n != 4 {
+		t.Errorf("%d records cached, want 4", n)
+	}
+}
+
+func TestCachedTTLCountsDown(t *testing.T) {
+	h := newTestHandler("127.0.0.1:1")
+	name := testName("countdown")
+	records.set(keyOf(name), testRecord(t, name, time.Now().Add(5*time.Second)))
+	ttl := func() uint32 {
+		m := query(h, name, dns.TypeA)
+		if len(m.Answer) != 1 {
+			t.Fatalf("answered %v", m.Answer)
+		}
+		return m.Answer[0].Header().Ttl
+	}
+	first := ttl()
+	if first != 5 {
+		t.Errorf("first TTL %d, want 5", first)
+	}
+	time.Sleep(1100 * time.Millisecond)
+	if second := ttl(); second >= first {
+		t.Errorf("TTL %d after %d a second earlier, want it counting down", second, first)
+	}
+}
+
+func TestRemainingTTL(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		expiry time.Time
+		want   uint32
+	}{
+		{time.Time{}, 3600},
+		{now.Add(time.Minute), 60},
+		{now.Add(1500 * time.Millisecond), 2},
+		{now.Add(time.Millisecond), 1},
+		{now, 0},
+		{now.Add(-time.Second), 0},
+	}
+	for _, tt := range tests {
+		if got := (record{expiry: tt.expiry}).remainingTTL(now, 3600); got != tt.want {
+			t.Errorf("remainingTTL with %s left = %d, want %d", tt.expiry.Sub(now), got, tt.want)
+		}
+	}
+}
+
+// BenchmarkRecordCache reads and writes the cache from every CPU at once,
+// nine reads to a write, with one lock for the whole cache and with
+// sharded ones.
+func BenchmarkRecordCache(b *testing.B) {
+	const names = 10000
+	fresh := time.Now().Add(time.Hour)
+	recs := make([]record, names)
+	keys := make([]cacheKey, names)
+	for i := range keys {
+		name := fmt.Sprintf("host%d.example.com.", i)
+		keys[i], recs[i] = keyOf(name), testRecord(b, name, fresh)
+	}
+	for _, shards := range []int{1, 4, 16, 64} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			c := newRecordCache(shards, 0)
+			for i, key := range keys {
+				c.set(key, recs[i])
+			}
+			var seed atomic.Uint64
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				i := int(seed.Add(7919))
+				for pb.Next() {
+					i = (i + 7919) % names
+					if i%10 == 0 {
+						c.set(keys[i], recs[i])
+					} else {
+						c.get(keys[i])
+					}
+				}
+			})
+		})
+	}
+}
+
+// cacheMix returns n record sets like those of real traffic: a CNAME to
+// two addresses, two AAAA records, a single A record or four of them.
+func cacheMix(b *testing.B, n int) ([]cacheKey, []record) {
+	keys := make([]cacheKey, n)
+	recs := make([]record, n)
+	fresh := time.Now().Add(time.Hour)
+	for i := range keys {
+		name := fmt.Sprintf("www.site%d.example.com.", i)
+		var lines []string
+		qtype := dns.TypeA
+		switch i % 4 {
+		case 0:
+			edge := fmt.Sprintf("edge%d.cdn.example.net.", i%100)
+			lines = []string{name + " 300 IN CNAME " + edge, edge + " 60 IN A 192.0.2.1", edge + " 60 IN A 192.0.2.2"}
+		case 1:
+			qtype = dns.TypeAAAA
+			lines = []string{name + " 300 IN AAAA 2001:db8::1", name + " 300 IN AAAA 2001:db8::2"}
+		case 2:
+			lines = []string{name + " 300 IN A 198.51.100.7"}
+		case 3:
+			for j := 1; j <= 4; j++ {
+				lines = append(lines, fmt.Sprintf("%s 300 IN A 203.0.113.%d", name, j))
+			}
+		}
+		rec := record{expiry: fresh}
+		for _, l := range lines {
+			rr, err := dns.NewRR(l)
+			if err != nil {
+				b.Fatal(err)
+			}
+			rec.rrs = append(rec.rrs, rr)
+		}
+		keys[i], recs[i] = cacheKey{name, qtype}, rec
+	}
+	return keys, recs
+}
+
+// BenchmarkCompressedCache compares -compress-cache with parsed records:
+// set and get report the cost of one operation, memory the heap taken by
+// each entry as bytes/entry.
+func BenchmarkCompressedCache(b *testing.B) {
+	const entries = 50000
+	for _, compressed := range []bool{false, true} {
+		mode := "parsed"
+		if compressed {
+			mode = "compressed"
+		}
+		b.Run(mode+"/memory", func(b *testing.B) {
+			b.ReportAllocs()
+			var perEntry float64
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				var before, after runtime.MemStats
+				runtime.GC()
+				runtime.ReadMemStats(&before)
+				keys, recs := cacheMix(b, entries)
+				b.StartTimer()
+				c := newRecordCache(1, 0)
+				c.compressed = compressed
+				for j, key := range keys {
+					c.set(key, recs[j])
+				}
+				b.StopTimer()
+				// only the cache keeps records alive now
+				keys, recs = nil, nil
+				runtime.GC()
+				runtime.ReadMemStats(&after)
+				perEntry = float64(int64(after.HeapAlloc)-int64(before.HeapAlloc)) / entries
+				runtime.KeepAlive(c)
+				b.StartTimer()
+			}
+			b.ReportMetric(perEntry, "bytes/entry")
+		})
+		keys, recs := cacheMix(b, entries)
+		c := newRecordCache(1, 0)
+		c.compressed = compressed
+		for j, key := range keys {
+			c.set(key, recs[j])
+		}
+		b.Run(mode+"/set", func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				j := i % entries
+				c.set(keys[j], recs[j])
+			}
+		})
+		b.Run(mode+"/get", func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, ok := c.get(keys[i%entries]); !ok {
+					b.Fatal("missing record")
+				}
+			}
+		})
+	}
+}
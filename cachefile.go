@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// cacheFormat is how saveCache writes the cache file, "text" or "binary".
+// loadCache reads either.
+var cacheFormat = "text"
+
+// Binary cache files start with cacheMagic and a version byte, followed by
+// one entry per record set: the name and the type, the expiry as unix
+// seconds or 0 for never, and the records in wire form, every length and
+// number a uvarint.
+const (
+	cacheMagic   = "IDNSCACHE"
+	cacheVersion = 1
+)
+
+// maxCacheField bounds the lengths read from a binary cache file, so that a
+// corrupt one fails instead of allocating without end.
+const maxCacheField = 1 << 16
+
+func writeCacheBinary(w *bufio.Writer, entries []cacheEntry) error {
+	w.WriteString(cacheMagic)
+	w.WriteByte(cacheVersion)
+	buf := make([]byte, binary.MaxVarintLen64)
+	putUvarint := func(x uint64) {
+		w.Write(buf[:binary.PutUvarint(buf, x)])
+	}
+	for _, e := range entries {
+		if e.rec.servfail {
+			continue
+		}
+		putUvarint(uint64(len(e.key.name)))
+		w.WriteString(e.key.name)
+		putUvarint(uint64(e.key.qtype))
+		var expiry uint64
+		if !e.rec.expiry.IsZero() {
+			expiry = uint64(e.rec.expiry.Unix())
+		}
+		putUvarint(expiry)
+		var packed [][]byte
+		for _, rr := range e.rec.rrs {
+			wire := make([]byte, dns.Len(rr))
+			n, err := dns.PackRR(rr, wire, 0, nil, false)
+			if err == nil {
+				packed = append(packed, wire[:n])
+			}
+		}
+		putUvarint(uint64(len(packed)))
+		for _, p := range packed {
+			putUvarint(uint64(len(p)))
+			w.Write(p)
+		}
+	}
+	return w.Flush()
+}
+
+// isBinaryCache reports whether r starts like a binary cache file.
+func isBinaryCache(r *bufio.Reader) bool {
+	magic, err := r.Peek(len(cacheMagic))
+	return err == nil && string(magic) == cacheMagic
+}
+
+// readCacheBinary calls fn for every record set of a binary cache file.
+func readCacheBinary(r *bufio.Reader, fn func(cacheKey, record)) error {
+	if _, err := r.Discard(len(cacheMagic)); err != nil {
+		return err
+	}
+	version, err := r.ReadByte()
+	if err != nil {
+		return err
+	}
+	if version != cacheVersion {
+		return fmt.Errorf("unsupported cache file version %d", version)
+	}
+	readLen := func() (int, error) {
+		n, err := binary.ReadUvarint(r)
+		if err == nil && n > maxCacheField {
+			err = errors.New("corrupt cache file")
+		}
+		return int(n), err
+	}
+	for {
+		n, err := readLen()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name := make([]byte, n)
+		if _, err := io.ReadFull(r, name); err != nil {
+			return err
+		}
+		qtype, err := readLen()
+		if err != nil {
+			return err
+		}
+		expiry, err := binary.ReadUvarint(r)
+		if err != nil {
+			return err
+		}
+		rec := record{source: sourceCacheFile}
+		if expiry != 0 {
+			rec.expiry = time.Unix(int64(expiry), 0)
+		}
+		count, err := readLen()
+		if err != nil {
+			return err
+		}
+		for i := 0; i < count; i++ {
+			n, err := readLen()
+			if err != nil {
+				return err
+			}
+			wire := make([]byte, n)
+			if _, err := io.ReadFull(r, wire); err != nil {
+				return err
+			}
+			rr, _, err := dns.UnpackRR(wire, 0)
+			if err != nil {
+				return err
+			}
+			rec.rrs = append(rec.rrs, rr)
+		}
+		fn(cacheKey{string(name), uint16(qtype)}, rec)
+	}
+}
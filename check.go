@@ -0,0 +1,94 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/likexian/doh-go"
+)
+
+// checkReadable returns an error unless path is empty or names a readable
+// regular file.
+func checkReadable(path string) error {
+	if path == "" {
+		return nil
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a regular file", path)
+	}
+	return nil
+}
+
+// checkNotDir returns an error if path names a directory, which os.Open
+// accepts and only reading or replacing the file fails on, far less clearly.
+func checkNotDir(kind, path string) error {
+	if path == "" {
+		return nil
+	}
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		return fmt.Errorf("%s path %s is a directory", kind, path)
+	}
+	return nil
+}
+
+// printSummary writes what the loaded configuration amounts to, for -check.
+func (h *dnsHandler) printSummary(w io.Writer, addr string) {
+	cached := records.len()
+	fmt.Fprintf(w, "listen address:     %s\n", addr)
+	conf := h.upstreamConfig()
+	fmt.Fprintf(w, "upstreams:          %v\n", conf.plain)
+	fmt.Fprintf(w, "pac upstreams:      %v\n", conf.pac)
+	fmt.Fprintf(w, "listener upstreams: %d\n", len(conf.byListener))
+	fmt.Fprintf(w, "pac rules:          %d\n", h.pacRuleCount())
+	fmt.Fprintf(w, "pac mode:           %s\n", h.pacMode)
+	fmt.Fprintf(w, "pac default:        %s\n", h.pacDefault)
+	fmt.Fprintf(w, "hosts entries:      %d\n", h.hosts.len())
+	fmt.Fprintf(w, "blocklist entries:  %d\n", h.blocklist.len())
+	fmt.Fprintf(w, "allowlist entries:  %d\n", h.allowlist.len())
+	fmt.Fprintf(w, "regex rules:        %d\n", len(h.regexes))
+	fmt.Fprintf(w, "ttl overrides:      %d\n", len(h.ttlOverrides))
+	fmt.Fprintf(w, "allowed clients:    %v\n", h.allowedClients)
+	fmt.Fprintf(w, "cached records:     %d\n", cached)
+	fmt.Fprintln(w, "configuration OK")
+}
+
+// logConfig logs the effective value of every flag, whether it comes from
+// the command line, the environment or the defaults, followed by what the
+// upstream configuration amounts to. Passwords in URLs are redacted.
+func (h *dnsHandler) logConfig(fs *flag.FlagSet) {
+	fs.VisitAll(func(f *flag.Flag) {
+		log.Printf("Config -%s=%s", f.Name, redactURL(f.Value.String()))
+	})
+	conf := h.upstreamConfig()
+	var providers []string
+	for _, id := range dohProviders {
+		providers = append(providers, doh.New(id).String())
+	}
+	log.Printf("Config upstreams %v, pac upstreams %v, listener upstreams %d, doh providers %v", conf.plain, conf.pac, len(conf.byListener), providers)
+}
+
+// redactURL hides the password of a value holding a URL.
+func redactURL(value string) string {
+	if !strings.Contains(value, "://") {
+		return value
+	}
+	u, err := url.Parse(value)
+	if err != nil || u.User == nil {
+		return value
+	}
+	return u.Redacted()
+}
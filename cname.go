@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// maxCNAMEChain bounds the links of a CNAME chain followed for one query,
+// so that long chains and loops end.
+const maxCNAMEChain = 8
+
+// chainEnd follows the CNAME records of rrs from name and returns the name
+// the chain ends at, unless rrs already hold its records of type qtype or
+// there is no chain.
+func chainEnd(rrs []dns.RR, name string, qtype uint16) (string, bool) {
+	target := name
+	for i := 0; i <= len(rrs); i++ {
+		next := ""
+		for _, rr := range rrs {
+			if !strings.EqualFold(rr.Header().Name, target) {
+				continue
+			}
+			if rr.Header().Rrtype == qtype {
+				return "", false
+			}
+			if cname, ok := rr.(*dns.CNAME); ok {
+				next = cname.Target
+			}
+		}
+		if next == "" {
+			break
+		}
+		target = next
+	}
+	return target, !strings.EqualFold(target, name)
+}
+
+// chaseCNAME completes an answer ending with a CNAME whose target's records
+// the upstream left out, resolving the target as a query of its own, so
+// that clients get the whole chain in one response.
+func (h *dnsHandler) chaseCNAME(ctx context.Context, q dns.Question, answers []dns.RR, rcode int) ([]dns.RR, int) {
+	if q.Qtype == dns.TypeCNAME || rcode != dns.RcodeSuccess {
+		return answers, rcode
+	}
+	req := h.requestFrom(ctx)
+	for i := 0; i < maxCNAMEChain; i++ {
+		target, ok := chainEnd(answers, q.Name, q.Qtype)
+		if !ok {
+			break
+		}
+		fctx, cancel, ok := req.followUp(ctx)
+		if !ok {
+			logOverBudget(q)
+			break
+		}
+		more, trcode, err := h.resolve(fctx, target, q.Qtype)
+		cancel()
+		if req.overBudget() {
+			logOverBudget(q)
+			break
+		}
+		if err != nil || trcode == dns.RcodeServerFailure {
+			if isDebug() {
+				log.Println(DEBUG_PREFIX, "chasing CNAME of", q.Name, "to", target, err)
+			}
+			break
+		}
+		answers = append(answers, more...)
+		// the rcode is that of the last name of the chain (RFC 6604)
+		rcode = trcode
+		if len(more) == 0 {
+			break
+		}
+	}
+	return answers, rcode
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type flight struct {
+	done chan struct{}
+	ua   upstreamAnswer
+}
+
+// coalescer lets identical upstream queries share a single fetch: queries
+// arriving while one is in flight, or within window after it completed,
+// wait for and reuse its answer instead of asking the upstreams again.
+type coalescer struct {
+	mu        sync.Mutex
+	flights   map[string]*flight
+	window    time.Duration
+	coalesced atomic.Uint64 // queries answered by another query's fetch
+}
+
+func newCoalescer(window time.Duration) *coalescer {
+	return &coalescer{flights: make(map[string]*flight), window: window}
+}
+
+// do returns the answer of fetch for key, calling it only if no fetch for
+// key is in flight or held, and always when key is empty. shared reports
+// whether the answer came from another caller, who then takes care of
+// caching it.
+func (c *coalescer) do(ctx context.Context, key string, fetch func() upstreamAnswer) (ua upstreamAnswer, shared bool) {
+	if c == nil || key == "" {
+		return fetch(), false
+	}
+	c.mu.Lock()
+	if f, ok := c.flights[key]; ok {
+		c.mu.Unlock()
+		c.coalesced.Add(1)
+		select {
+		case <-f.done:
+			return f.ua, true
+		case <-ctx.Done():
+			return upstreamAnswer{err: ctx.Err()}, true
+		}
+	}
+	f := &flight{done: make(chan struct{})}
+	c.flights[key] = f
+	c.mu.Unlock()
+
+	f.ua = fetch()
+	close(f.done)
+	forget := func() {
+		c.mu.Lock()
+		delete(c.flights, key)
+		c.mu.Unlock()
+	}
+	if c.window > 0 {
+		time.AfterFunc(c.window, forget)
+	} else {
+		forget()
+	}
+	return f.ua, false
+}
+
+// flightKey identifies the queries coalesced with a query for name. Queries
+// relaying EDNS0 options of their own, like a client subnet, may get
+// answers meant for them only and are never coalesced.
+func (h *dnsHandler) flightKey(name string, qtype uint16, req *request) string {
+	if len(req.opts) > 0 {
+		return ""
+	}
+	return fmt.Sprintf("%s %d %s", name, qtype, strings.Join(req.upstreams.addrs, ","))
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// parseDNS64Prefix parses a NAT64 prefix of one of the lengths RFC 6052
+// allows.
+func parseDNS64Prefix(s string) (*net.IPNet, error) {
+	ip, prefix, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, err
+	}
+	if ip.To4() != nil {
+		return nil, fmt.Errorf("%s is not an IPv6 prefix", s)
+	}
+	switch ones, _ := prefix.Mask.Size(); ones {
+	case 32, 40, 48, 56, 64, 96:
+	default:
+		return nil, fmt.Errorf("%s is not 32, 40, 48, 56, 64 or 96 bits long", s)
+	}
+	return prefix, nil
+}
+
+// embedIPv4 builds the IPv6 address embedding v4 in prefix (RFC 6052 2.2).
+// Bits 64 to 71 are reserved and stay zero, so the IPv4 address wraps
+// around them for prefixes shorter than 96 bits.
+func embedIPv4(prefix *net.IPNet, v4 net.IP) net.IP {
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, prefix.IP.To16())
+	ones, _ := prefix.Mask.Size()
+	pos := ones / 8
+	for _, b := range v4.To4() {
+		if pos == 8 {
+			pos++
+		}
+		ip[pos] = b
+		pos++
+	}
+	return ip
+}
+
+// synthesizeAAAA turns the answer to an A query into the answer to the
+// corresponding AAAA query through NAT64 (RFC 6147): the CNAME chain is
+// kept and every A record becomes an AAAA record of the embedded address.
+func synthesizeAAAA(prefix *net.IPNet, rrs []dns.RR) []dns.RR {
+	var synthesized []dns.RR
+	for _, rr := range rrs {
+		a, ok := rr.(*dns.A)
+		if !ok {
+			if rr.Header().Rrtype == dns.TypeCNAME {
+				synthesized = append(synthesized, rr)
+			}
+			continue
+		}
+		hdr := a.Hdr
+		hdr.Rrtype = dns.TypeAAAA
+		synthesized = append(synthesized, &dns.AAAA{Hdr: hdr, AAAA: embedIPv4(prefix, a.A)})
+	}
+	return synthesized
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/likexian/doh-go"
+	hdns "github.com/likexian/doh-go/dns"
+	"github.com/miekg/dns"
+)
+
+var dohProviders = []int{doh.Quad9Provider, doh.CloudflareProvider, doh.GoogleProvider}
+
+// dohStatusError is returned when a provider answered with a failure rcode.
+type dohStatusError int
+
+func (e dohStatusError) Error() string {
+	return fmt.Sprintf("doh: failed response code %s", dns.RcodeToString[int(e)])
+}
+
+// transientDoHError reports whether a DoH query failing with err is worth
+// retrying. An answer carrying a failure rcode is final, as is a cancelled
+// query.
+func transientDoHError(err error) bool {
+	var status dohStatusError
+	return !errors.As(err, &status) && !errors.Is(err, context.Canceled)
+}
+
+// dohAnswer converts the answer of a DoH response to records, dropping
+// duplicates and anything that does not parse.
+func dohAnswer(name string, qtype uint16, rsp *hdns.Response) upstreamAnswer {
+	var rrs []dns.RR
+	seen := make(map[string]bool)
+	for _, a := range rsp.Answer {
+		if isDebug() {
+			fmt.Printf("[DEBUG] doh %s -> %s\n", a.Name, a.Data)
+		}
+		rr, err := dns.NewRR(fmt.Sprintf("%s %d IN %s %s", dns.Fqdn(a.Name), a.TTL, dns.TypeToString[uint16(a.Type)], a.Data))
+		if err != nil || rr == nil || seen[rr.String()] {
+			continue
+		}
+		seen[rr.String()] = true
+		rrs = append(rrs, rr)
+	}
+	ua := newUpstreamAnswer(rrs)
+	ua.ad = rsp.AD
+	ua.source = sourceDoH
+	return ua
+}
+
+// hasType reports whether ua holds a record of type qtype, as opposed to
+// only a CNAME chain or nothing at all.
+func (ua upstreamAnswer) hasType(qtype uint16) bool {
+	for _, rr := range ua.rrs {
+		if rr.Header().Rrtype == qtype {
+			return true
+		}
+	}
+	return false
+}
+
+// dohClients returns the clients of dohProviders, which go through -proxy
+// when it is set.
+func (h *dnsHandler) dohClients() []doh.Provider {
+	providers := make([]doh.Provider, len(dohProviders))
+	for i, id := range dohProviders {
+		providers[i] = doh.New(id)
+		if h.dohTransport != nil {
+			providers[i] = &proxiedProvider{name: providers[i].String(), url: dohURLs[id], transport: h.dohTransport}
+		}
+	}
+	return providers
+}
+
+// queryProviders queries every DoH provider at once and returns the first
+// response, or with wantType the first one carrying valid records of qtype.
+// The remaining queries are cancelled as soon as one wins. A provider
+// answering with a failure rcode fails with a dohStatusError.
+func queryProviders(ctx context.Context, providers []doh.Provider, name string, qtype uint16, wantType bool) (*hdns.Response, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		rsp *hdns.Response
+		err error
+	}
+	results := make(chan result, len(providers))
+	for _, p := range providers {
+		go func(p doh.Provider) {
+			rsp, err := p.Query(ctx, hdns.Domain(name), hdns.Type(dns.TypeToString[qtype]))
+			results <- result{rsp, err}
+		}(p)
+	}
+
+	var empty *hdns.Response
+	var err error
+	for range providers {
+		res := <-results
+		var status dohStatusError
+		switch {
+		case res.err != nil && res.rsp != nil:
+			// an NXDOMAIN is authoritative, the other providers failing
+			// must not hide it: pac names answered so must not be asked
+			// to the plain upstreams
+			if !errors.As(err, &status) || int(status) != dns.RcodeNameError {
+				err = dohStatusError(res.rsp.Status)
+			}
+		case res.err != nil:
+			if !errors.As(err, &status) {
+				err = res.err
+			}
+		case !wantType || dohAnswer(name, qtype, res.rsp).hasType(qtype):
+			return res.rsp, nil
+		default:
+			empty = res.rsp
+		}
+	}
+	if empty != nil {
+		// a provider answered, just not with a record of qtype
+		return empty, nil
+	}
+	return nil, err
+}
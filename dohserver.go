@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+
+	"github.com/miekg/dns"
+)
+
+// dohWriter collects the answer ServeDNS writes for a DoH request. Queries
+// are taken as arriving over TCP, so that answers are never truncated.
+type dohWriter struct {
+	local, remote net.Addr
+	msg           *dns.Msg
+}
+
+func (w *dohWriter) LocalAddr() net.Addr  { return w.local }
+func (w *dohWriter) RemoteAddr() net.Addr { return w.remote }
+
+func (w *dohWriter) WriteMsg(m *dns.Msg) error {
+	w.msg = m
+	return nil
+}
+
+func (w *dohWriter) Write(b []byte) (int, error) {
+	m := new(dns.Msg)
+	if err := m.Unpack(b); err != nil {
+		return 0, err
+	}
+	w.msg = m
+	return len(b), nil
+}
+
+func (w *dohWriter) Close() error        { return nil }
+func (w *dohWriter) TsigStatus() error   { return nil }
+func (w *dohWriter) TsigTimersOnly(bool) {}
+func (w *dohWriter) Hijack()             {}
+
+// tcpAddr converts the address of an HTTP connection.
+func tcpAddr(addr string) net.Addr {
+	a, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return nil
+	}
+	return a
+}
+
+// cacheMaxAge returns how long HTTP caches may keep an answer, which RFC
+// 8484 bounds by the smallest TTL of its records. Failures and answers
+// without records are not cached.
+func cacheMaxAge(m *dns.Msg) uint32 {
+	if m.Rcode != dns.RcodeSuccess && m.Rcode != dns.RcodeNameError {
+		return 0
+	}
+	var ttl uint32
+	found := false
+	for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+			if !found || rr.Header().Ttl < ttl {
+				ttl, found = rr.Header().Ttl, true
+			}
+		}
+	}
+	return ttl
+}
+
+// serveDNSQuery answers RFC 8484 requests, GET with the query in the dns
+// parameter or POST with it as the body.
+func (h *dnsHandler) serveDNSQuery(w http.ResponseWriter, r *http.Request) {
+	var wire []byte
+	var err error
+	switch r.Method {
+	case http.MethodGet:
+		wire, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+	case http.MethodPost:
+		if r.Header.Get("Content-Type") != "application/dns-message" {
+			http.Error(w, "unsupported content type", http.StatusUnsupportedMediaType)
+			return
+		}
+		wire, err = io.ReadAll(io.LimitReader(r.Body, dns.MaxMsgSize))
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	req := new(dns.Msg)
+	if err == nil {
+		err = req.Unpack(wire)
+	}
+	if err != nil {
+		http.Error(w, "invalid query", http.StatusBadRequest)
+		return
+	}
+	dw := &dohWriter{remote: tcpAddr(r.RemoteAddr)}
+	if local, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		dw.local = local
+	}
+	h.ServeDNS(dw, req)
+	if dw.msg == nil {
+		http.Error(w, "no answer", http.StatusInternalServerError)
+		return
+	}
+	buf, err := dw.msg.Pack()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/dns-message")
+	w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", cacheMaxAge(dw.msg)))
+	w.Write(buf)
+}
+
+// serveDoH serves DNS over HTTPS at /dns-query, over plain HTTP unless a
+// certificate is given, for deployments behind a TLS terminating proxy. The
+// server is returned for shutting it down.
+func (h *dnsHandler) serveDoH(addr, certFile, keyFile string) *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/dns-query", h.serveDNSQuery)
+	srv := &http.Server{Addr: addr, Handler: mux}
+	log.Printf("Serving DNS over HTTPS at %s\n", addr)
+	go func() {
+		var err error
+		if certFile != "" {
+			err = srv.ListenAndServeTLS(certFile, keyFile)
+		} else {
+			err = srv.ListenAndServe()
+		}
+		if err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+	return srv
+}
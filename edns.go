@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/hex"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// parseOptionCodes parses a comma separated list of EDNS0 option codes.
+func parseOptionCodes(list string) (map[uint16]bool, error) {
+	codes := make(map[uint16]bool)
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		code, err := strconv.ParseUint(s, 10, 16)
+		if err != nil {
+			return nil, err
+		}
+		codes[uint16(code)] = true
+	}
+	return codes, nil
+}
+
+// relayedOptions returns the EDNS0 options of msg configured for passthrough.
+func (h *dnsHandler) relayedOptions(msg *dns.Msg) []dns.EDNS0 {
+	opt := msg.IsEdns0()
+	if opt == nil || len(h.ednsPassthrough) == 0 {
+		return nil
+	}
+	var opts []dns.EDNS0
+	for _, o := range opt.Option {
+		// NSID in the query concerns idns itself, see answerNSID
+		if h.ednsPassthrough[o.Option()] && !(o.Option() == dns.EDNS0NSID && h.nsid != "") {
+			opts = append(opts, o)
+		}
+	}
+	return opts
+}
+
+// setExtendedError records why the answer deviates from what upstreams
+// would say as an extended DNS error (RFC 8914), sent to clients speaking
+// EDNS0. The first reason of a query is kept.
+func (req *request) setExtendedError(code uint16, text string) {
+	if req.ede == nil {
+		req.ede = &dns.EDNS0_EDE{InfoCode: code, ExtraText: text}
+	}
+}
+
+// addOptions appends opts to the OPT record of m, skipping options whose
+// code is already present.
+func addOptions(m *dns.Msg, opts []dns.EDNS0) {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return
+	}
+	for _, o := range opts {
+		dup := false
+		for _, e := range opt.Option {
+			if e.Option() == o.Option() {
+				dup = true
+				break
+			}
+		}
+		if !dup {
+			opt.Option = append(opt.Option, o)
+		}
+	}
+}
+
+// answerNSID adds the server identifier to m when the query r requests it.
+func (h *dnsHandler) answerNSID(r, m *dns.Msg) {
+	if h.nsid == "" {
+		return
+	}
+	for _, o := range r.IsEdns0().Option {
+		if o.Option() == dns.EDNS0NSID {
+			addOptions(m, []dns.EDNS0{&dns.EDNS0_NSID{Code: dns.EDNS0NSID, Nsid: hex.EncodeToString([]byte(h.nsid))}})
+			return
+		}
+	}
+}
@@ -5,13 +5,14 @@ go 1.20
 require (
 	github.com/likexian/doh-go v0.6.4
 	github.com/miekg/dns v1.1.55
+	go.etcd.io/bbolt v1.3.7
+	golang.org/x/net v0.2.0
+	golang.org/x/sys v0.4.0
 )
 
 require (
 	github.com/likexian/gokit v0.21.11 // indirect
 	golang.org/x/mod v0.7.0 // indirect
-	golang.org/x/net v0.2.0 // indirect
-	golang.org/x/sys v0.2.0 // indirect
 	golang.org/x/text v0.4.0 // indirect
 	golang.org/x/tools v0.3.0 // indirect
 )
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// hostsTable is a read-only index from names to addresses. It is kept as a
+// pair of sorted parallel slices rather than a map so that hosts files and
+// blocklists with millions of entries stay compact and load quickly.
+type hostsTable struct {
+	names []string   // lowercase, without the trailing dot
+	addrs [][]net.IP // addrs[i] holds the addresses of names[i]
+	// the few names listed with time ranges only match during them
+	schedules map[string][]timeRange
+}
+
+// timeRange is a daily window of local time in minutes since midnight. One
+// ending before it starts spans midnight.
+type timeRange struct {
+	from, to int
+}
+
+// parseTimeRange parses "HH:MM-HH:MM".
+func parseTimeRange(s string) (timeRange, bool) {
+	from, to, ok := strings.Cut(s, "-")
+	if !ok {
+		return timeRange{}, false
+	}
+	f, err1 := time.Parse("15:04", from)
+	t, err2 := time.Parse("15:04", to)
+	if err1 != nil || err2 != nil {
+		return timeRange{}, false
+	}
+	return timeRange{f.Hour()*60 + f.Minute(), t.Hour()*60 + t.Minute()}, true
+}
+
+func (r timeRange) contains(now time.Time) bool {
+	m := now.Hour()*60 + now.Minute()
+	if r.from <= r.to {
+		return r.from <= m && m < r.to
+	}
+	return m >= r.from || m < r.to
+}
+
+type hostsEntry struct {
+	name string
+	ip   net.IP
+}
+
+// loadHostsTable reads a hosts style file ("ip name [name...]") or a plain
+// list of names, one per line. Lines starting with # are ignored. Time
+// ranges like 22:00-06:00 on a line restrict when its names match.
+func loadHostsTable(path string) (*hostsTable, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseHostsTable(data), nil
+}
+
+// parseHostsTable builds the table of a hosts style file's content.
+func parseHostsTable(data []byte) *hostsTable {
+	// names are sliced out of this single string, so they share its backing
+	// array instead of being allocated one by one
+	content := string(data)
+	data = nil
+
+	var entries []hostsEntry
+	ips := make(map[string]net.IP)
+	schedules := make(map[string][]timeRange)
+	unscheduled := make(map[string]bool)
+	for len(content) > 0 {
+		var line string
+		if i := strings.IndexByte(content, '\n'); i >= 0 {
+			line, content = content[:i], content[i+1:]
+		} else {
+			line, content = content, ""
+		}
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		var ip net.IP
+		if parsed := net.ParseIP(fields[0]); parsed != nil {
+			if ip = ips[fields[0]]; ip == nil {
+				ip = parsed
+				ips[fields[0]] = ip
+			}
+			fields = fields[1:]
+		}
+		var ranges []timeRange
+		names := fields[:0]
+		for _, f := range fields {
+			if r, ok := parseTimeRange(f); ok {
+				ranges = append(ranges, r)
+			} else {
+				names = append(names, f)
+			}
+		}
+		for _, name := range names {
+			name = strings.TrimSuffix(strings.ToLower(name), ".")
+			entries = append(entries, hostsEntry{name: name, ip: ip})
+			if len(ranges) == 0 {
+				unscheduled[name] = true
+			} else {
+				schedules[name] = append(schedules[name], ranges...)
+			}
+		}
+	}
+	// a name also listed without a time range always matches
+	for name := range unscheduled {
+		delete(schedules, name)
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].name < entries[j].name })
+	t := &hostsTable{}
+	if len(schedules) > 0 {
+		t.schedules = schedules
+	}
+	for _, e := range entries {
+		n := len(t.names)
+		if n == 0 || t.names[n-1] != e.name {
+			t.names = append(t.names, e.name)
+			t.addrs = append(t.addrs, nil)
+			n++
+		}
+		if e.ip != nil {
+			t.addrs[n-1] = append(t.addrs[n-1], e.ip)
+		}
+	}
+	return t
+}
+
+func (t *hostsTable) index(name string) int {
+	if t == nil {
+		return -1
+	}
+	name = strings.TrimSuffix(name, ".")
+	i := sort.SearchStrings(t.names, name)
+	if i < len(t.names) && t.names[i] == name {
+		return i
+	}
+	return -1
+}
+
+// lookup returns the addresses pinned for exactly name.
+func (t *hostsTable) lookup(name string) ([]net.IP, bool) {
+	i := t.index(name)
+	if i < 0 {
+		return nil, false
+	}
+	return t.addrs[i], true
+}
+
+// matches reports whether name or any of its parent domains is listed, and
+// within its time ranges if it has any.
+func (t *hostsTable) matches(name string) bool {
+	name = strings.TrimSuffix(name, ".")
+	for name != "" {
+		if t.index(name) >= 0 && t.scheduled(name, time.Now()) {
+			return true
+		}
+		i := strings.IndexByte(name, '.')
+		if i < 0 {
+			break
+		}
+		name = name[i+1:]
+	}
+	return false
+}
+
+func (t *hostsTable) scheduled(name string, now time.Time) bool {
+	ranges, ok := t.schedules[name]
+	if !ok {
+		return true
+	}
+	for _, r := range ranges {
+		if r.contains(now) {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *hostsTable) len() int {
+	if t == nil {
+		return 0
+	}
+	return len(t.names)
+}
+
+// pinnedRRs builds the answer for q from pinned addresses, keeping only the
+// family q asks for. The result is empty when the name has no address of
+// that family, and for any type other than A and AAAA.
+func pinnedRRs(q dns.Question, ips []net.IP, ttl uint32) []dns.RR {
+	if q.Qtype != dns.TypeA && q.Qtype != dns.TypeAAAA {
+		return nil
+	}
+	var rrs []dns.RR
+	for _, ip := range ips {
+		v4 := ip.To4() != nil
+		if q.Qtype == dns.TypeA && !v4 || q.Qtype == dns.TypeAAAA && v4 {
+			continue
+		}
+		rr, err := dns.NewRR(fmt.Sprintf("%s %d %s %s", q.Name, ttl, dns.TypeToString[q.Qtype], ip))
+		if err == nil {
+			rrs = append(rrs, rr)
+		}
+	}
+	return rrs
+}
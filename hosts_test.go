@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestPinnedHostsAnswerBothFamilies(t *testing.T) {
+	var queries atomic.Int32
+	addr := startUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		queries.Add(1)
+		m := new(dns.Msg)
+		m.SetReply(r)
+		rr, _ := dns.NewRR(r.Question[0].Name + " 300 IN AAAA 2001:db8::1")
+		m.Answer = append(m.Answer, rr)
+		w.WriteMsg(m)
+	})
+	h := newTestHandler(addr)
+	h.hosts = parseHostsTable([]byte("192.0.2.5 pinned.example.com\n"))
+
+	m := query(h, "pinned.example.com.", dns.TypeA)
+	if a := onlyType(m.Answer, dns.TypeA); len(a) != 1 || a[0].(*dns.A).A.String() != "192.0.2.5" {
+		t.Errorf("A answered %v, want the pinned address", m.Answer)
+	}
+	// the pin has no IPv6 address, which must not come from upstreams
+	m = query(h, "pinned.example.com.", dns.TypeAAAA)
+	if m.Rcode != dns.RcodeSuccess || len(m.Answer) != 0 {
+		t.Errorf("AAAA answered %s %v, want NODATA", dns.RcodeToString[m.Rcode], m.Answer)
+	}
+	if n := queries.Load(); n != 0 {
+		t.Errorf("%d upstream queries for a pinned name", n)
+	}
+}
+
+func TestPinnedRRsByType(t *testing.T) {
+	ips := []net.IP{net.ParseIP("192.0.2.5"), net.ParseIP("2001:db8::5")}
+	for qtype, want := range map[uint16]string{dns.TypeA: "192.0.2.5", dns.TypeAAAA: "2001:db8::5"} {
+		rrs := pinnedRRs(dns.Question{Name: "pinned.example.com.", Qtype: qtype, Qclass: dns.ClassINET}, ips, 60)
+		if len(rrs) != 1 || !strings.HasSuffix(rrs[0].String(), "\t"+want) {
+			t.Errorf("%s answered %v, want %s", dns.TypeToString[qtype], rrs, want)
+		}
+	}
+	for _, qtype := range []uint16{dns.TypeMX, dns.TypeTXT, dns.TypeCAA} {
+		if rrs := pinnedRRs(dns.Question{Name: "pinned.example.com.", Qtype: qtype, Qclass: dns.ClassINET}, ips, 60); rrs != nil {
+			t.Errorf("%s answered %v from pinned addresses", dns.TypeToString[qtype], rrs)
+		}
+	}
+}
+
+// writeHostsFile writes a hosts file of n entries, one per line, to a
+// temporary directory.
+func writeHostsFile(b *testing.B, n int) string {
+	var buf bytes.Buffer
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&buf, "10.%d.%d.%d host%d.example%d.com\n", i>>16&0xff, i>>8&0xff, i&0xff, i, i%1000)
+	}
+	path := filepath.Join(b.TempDir(), "hosts")
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		b.Fatal(err)
+	}
+	return path
+}
+
+// BenchmarkLoadHostsTable loads a hosts file of a million entries, reporting
+// the heap the table keeps alive as table-bytes.
+func BenchmarkLoadHostsTable(b *testing.B) {
+	path := writeHostsFile(b, 1000000)
+	b.ReportAllocs()
+	b.ResetTimer()
+	var retained uint64
+	for i := 0; i < b.N; i++ {
+		var before, after runtime.MemStats
+		b.StopTimer()
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+		b.StartTimer()
+		t, err := loadHostsTable(path)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.StopTimer()
+		runtime.GC()
+		runtime.ReadMemStats(&after)
+		if t.len() != 1000000 {
+			b.Fatalf("loaded %d entries", t.len())
+		}
+		retained = after.HeapAlloc - before.HeapAlloc
+		runtime.KeepAlive(t)
+	}
+	b.ReportMetric(float64(retained), "table-bytes")
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/idna"
+)
+
+// normalizeName converts a query name holding Unicode labels to its
+// punycode form, so that "bücher.de." and "xn--bcher-kva.de." share cache
+// entries and upstream queries. Names that are plain ASCII, or not valid
+// IDNs, are returned as they are.
+func normalizeName(name string) string {
+	raw, ok := unescapeName(name)
+	if !ok {
+		return name
+	}
+	ascii := true
+	for i := 0; i < len(raw); i++ {
+		if raw[i] >= 0x80 {
+			ascii = false
+			break
+		}
+	}
+	if ascii {
+		return name
+	}
+	normalized, err := idna.Lookup.ToASCII(raw)
+	if err != nil {
+		return name
+	}
+	return normalized
+}
+
+// maxNameLength is the longest a name may be in wire format.
+const maxNameLength = 255
+
+// validName reports whether name fits the wire format: no empty label, none
+// longer than 63 bytes and at most maxNameLength bytes in all.
+func validName(name string) bool {
+	// room for names too long by a label, so they fail on length
+	buf := make([]byte, 2*maxNameLength)
+	n, err := dns.PackDomainName(name, buf, 0, nil, false)
+	return err == nil && n <= maxNameLength
+}
+
+// unescapeName undoes the \DDD and \X escaping of dns.Msg names. It fails
+// on escaped dots, which cannot be told apart from label separators once
+// unescaped.
+func unescapeName(name string) (string, bool) {
+	if !strings.Contains(name, `\`) {
+		return name, true
+	}
+	var b strings.Builder
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if c != '\\' || i+1 == len(name) {
+			b.WriteByte(c)
+			continue
+		}
+		if i+3 < len(name) {
+			if n, err := strconv.ParseUint(name[i+1:i+4], 10, 8); err == nil {
+				c, i = byte(n), i+3
+				if c == '.' {
+					return "", false
+				}
+				b.WriteByte(c)
+				continue
+			}
+		}
+		i++
+		if name[i] == '.' {
+			return "", false
+		}
+		b.WriteByte(name[i])
+	}
+	return b.String(), true
+}
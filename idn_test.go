@@ -0,0 +1,79 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNormalizeName(t *testing.T) {
+	tests := []struct {
+		name, want string
+	}{
+		{"example.com.", "example.com."},
+		{"bücher.de.", "xn--bcher-kva.de."},
+		{"BÜCHER.de.", "xn--bcher-kva.de."},
+		// how dns.Msg spells the UTF-8 of ü
+		{`b\195\188cher.de.`, "xn--bcher-kva.de."},
+		{"xn--bcher-kva.de.", "xn--bcher-kva.de."},
+		{"münchen.bücher.de.", "xn--mnchen-3ya.xn--bcher-kva.de."},
+		// an escaped dot is part of a label, left as it is
+		{`b\195\188cher\.x.de.`, `b\195\188cher\.x.de.`},
+		{`b\195\188cher\046x.de.`, `b\195\188cher\046x.de.`},
+		// not a valid IDN
+		{"bü_cher.de.", "bü_cher.de."},
+	}
+	for _, tt := range tests {
+		if got := normalizeName(tt.name); got != tt.want {
+			t.Errorf("normalizeName(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestUnescapeName(t *testing.T) {
+	tests := []struct {
+		name, want string
+		ok         bool
+	}{
+		{"example.com.", "example.com.", true},
+		{`b\195\188cher.de.`, "bücher.de.", true},
+		{`\065BC.com.`, "ABC.com.", true},
+		{`a\"b.com.`, `a"b.com.`, true},
+		{`a\\b.com.`, `a\b.com.`, true},
+		{`a\.b.com.`, "", false},
+		{`a\046b.com.`, "", false},
+	}
+	for _, tt := range tests {
+		got, ok := unescapeName(tt.name)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("unescapeName(%q) = %q, %v, want %q, %v", tt.name, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestValidName(t *testing.T) {
+	label63 := strings.Repeat("a", 63)
+	label64 := strings.Repeat("a", 64)
+	// three labels of 63 bytes, one of 61 and their length bytes make
+	// 255 bytes in wire format with the root
+	long := strings.Repeat(label63+".", 3) + strings.Repeat("a", 61) + "."
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"example.com.", true},
+		{".", true},
+		{label63 + ".com.", true},
+		{label64 + ".com.", false},
+		{long, true},
+		{"a." + long, false},
+		{strings.Repeat("a.", 128), false},
+		{"a..com.", false},
+		{"..", false},
+		{".com.", false},
+	}
+	for _, tt := range tests {
+		if got := validName(tt.name); got != tt.want {
+			t.Errorf("validName(%q) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"log"
+	"net"
+	"time"
+)
+
+// probeIPv6 periodically checks whether target can be reached over IPv6 and
+// records the result in h.ipv6Down, logging every change of state.
+func (h *dnsHandler) probeIPv6(target string, interval time.Duration) {
+	check := func() {
+		conn, err := net.DialTimeout("tcp6", target, 3*time.Second)
+		if err == nil {
+			conn.Close()
+		}
+		down := err != nil
+		if h.ipv6Down.Swap(down) != down || isDebug() {
+			if down {
+				log.Printf("IPv6 is unreachable (%s), answering AAAA queries with NODATA", err)
+			} else {
+				log.Println("IPv6 is reachable, answering AAAA queries")
+			}
+		}
+	}
+	// assume IPv6 works until a probe says otherwise
+	check()
+	for range time.Tick(interval) {
+		check()
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !unix
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"runtime"
+)
+
+// listenUDP fails, the socket buffer sizes only being set on unix systems.
+func listenUDP(addr string, rcvbuf, sndbuf int) (net.PacketConn, error) {
+	return nil, fmt.Errorf("-udp-rcvbuf and -udp-sndbuf are not supported on %s", runtime.GOOS)
+}
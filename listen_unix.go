@@ -0,0 +1,48 @@
+//go:build unix
+
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// listenUDP opens the socket of a UDP server at addr with the buffer sizes
+// of -udp-rcvbuf and -udp-sndbuf, 0 keeping the system default, and logs
+// the sizes applied, which the kernel may clamp. Like the sockets dns.Server
+// opens itself, it reuses the port.
+func listenUDP(addr string, rcvbuf, sndbuf int) (net.PacketConn, error) {
+	lc := net.ListenConfig{Control: func(network, address string, c syscall.RawConn) error {
+		var err error
+		c.Control(func(fd uintptr) {
+			if err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1); err != nil {
+				return
+			}
+			if rcvbuf > 0 {
+				if err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_RCVBUF, rcvbuf); err != nil {
+					return
+				}
+			}
+			if sndbuf > 0 {
+				err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_SNDBUF, sndbuf)
+			}
+		})
+		return err
+	}}
+	pc, err := lc.ListenPacket(context.Background(), "udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if raw, err := pc.(*net.UDPConn).SyscallConn(); err == nil {
+		raw.Control(func(fd uintptr) {
+			rcv, _ := unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_RCVBUF)
+			snd, _ := unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_SNDBUF)
+			log.Printf("UDP socket buffers of %s: %d bytes receive, %d bytes send", addr, rcv, snd)
+		})
+	}
+	return pc, nil
+}
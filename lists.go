@@ -0,0 +1,40 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// blocked reports whether name is answered with NXDOMAIN: it or a parent
+// domain is on the blocklist and neither is on the allowlist.
+func (h *dnsHandler) blocked(name string) bool {
+	h.listsMu.RLock()
+	defer h.listsMu.RUnlock()
+	return h.blocklist.matches(name) && !h.allowlist.matches(name)
+}
+
+func (h *dnsHandler) setLists(blocklist, allowlist *hostsTable) {
+	h.listsMu.Lock()
+	defer h.listsMu.Unlock()
+	h.blocklist, h.allowlist = blocklist, allowlist
+}
+
+// reloadLists reads the blocklist and the allowlist again, keeping both as
+// they were if either fails to load.
+func (h *dnsHandler) reloadLists(blocklist, allowlist RuleSource) {
+	start := time.Now()
+	var lists [2]*hostsTable
+	for i, src := range []RuleSource{blocklist, allowlist} {
+		if src == nil {
+			continue
+		}
+		data, err := src.Read()
+		if err != nil {
+			log.Printf("Failed to reload %s, keeping the loaded lists: %s", src, err)
+			return
+		}
+		lists[i] = parseHostsTable(data)
+	}
+	h.setLists(lists[0], lists[1])
+	log.Printf("Reloaded %d blocklist and %d allowlist entries in %s", lists[0].len(), lists[1].len(), time.Since(start))
+}
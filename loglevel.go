@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+// Log levels, from the least verbose. Messages of the debug level start with
+// DEBUG_PREFIX.
+const (
+	levelInfo int32 = iota
+	levelDebug
+)
+
+var logLevelNames = []string{"info", "debug"}
+
+// logLevel is read on every query, so that -log-level, IDNS_DEBUG=1,
+// SIGUSR2 and the admin API can change it without a restart.
+var logLevel atomic.Int32
+
+func isDebug() bool {
+	return logLevel.Load() >= levelDebug
+}
+
+// initialLogLevel is the level of -log-level, or debug when IDNS_DEBUG=1.
+func initialLogLevel(name string) (int32, error) {
+	if os.Getenv(IDNS_DEBUG) == "1" {
+		return levelDebug, nil
+	}
+	return parseLogLevel(name)
+}
+
+func parseLogLevel(name string) (int32, error) {
+	for i, n := range logLevelNames {
+		if strings.EqualFold(name, n) {
+			return int32(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q, want one of %s", name, strings.Join(logLevelNames, ", "))
+}
+
+func logLevelName() string {
+	return logLevelNames[logLevel.Load()]
+}
+
+// setLogLevel changes the level, logging when it does.
+func setLogLevel(level int32) {
+	if logLevel.Swap(level) != level {
+		log.Printf("Log level set to %s", logLevelNames[level])
+	}
+}
+
+// cycleLogLevel moves to the next more verbose level, after the most verbose
+// back to the least, for SIGUSR2.
+func cycleLogLevel() {
+	setLogLevel((logLevel.Load() + 1) % int32(len(logLevelNames)))
+}
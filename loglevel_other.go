@@ -0,0 +1,7 @@
+//go:build !unix
+
+package main
+
+// cycleLogLevelOnSignal does nothing, there being no SIGUSR2 to cycle the
+// log levels with. The admin API still sets them.
+func cycleLogLevelOnSignal() {}
@@ -0,0 +1,20 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// cycleLogLevelOnSignal cycles through the log levels on every SIGUSR2.
+func cycleLogLevelOnSignal() {
+	usr2 := make(chan os.Signal, 1)
+	signal.Notify(usr2, syscall.SIGUSR2)
+	go func() {
+		for range usr2 {
+			cycleLogLevel()
+		}
+	}()
+}
@@ -3,26 +3,157 @@ package main
 import (
 	"bufio"
 	"context"
+	"encoding/base64"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
+	"math/rand"
+	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
-	"github.com/likexian/doh-go"
 	hdns "github.com/likexian/doh-go/dns"
 	"github.com/miekg/dns"
+	"golang.org/x/net/proxy"
 )
 
-var mutex = &sync.Mutex{}
-var records = make(map[string][]string) // Global map to hold DNS records
+var mutex = &sync.Mutex{}          // serializes writes of the cache file
+var records = newRecordCache(1, 0) // Global cache holding DNS records
+var cacheDirty atomic.Bool         // records changed since -cache-flush-interval last wrote them
+
+type cacheKey struct {
+	name  string
+	qtype uint16
+}
+
+type record struct {
+	rrs    []dns.RR
+	expiry time.Time // zero means the record never expires
+	// servfail marks a remembered upstream failure rather than records,
+	// it is kept in memory only
+	servfail bool
+	source   string // where the records were resolved, one of the source constants
+	// the upstream validated the records with DNSSEC, kept in memory only
+	authenticated bool
+}
+
+// Sources of cached records, as listed by the admin API.
+const (
+	sourceUpstream  = "upstream"
+	sourceDoH       = "doh"
+	sourceCacheFile = "file" // loaded from -cache, where the source is not kept
+)
+
+func (r record) expired(now time.Time) bool {
+	return !r.expiry.IsZero() && !now.Before(r.expiry)
+}
+
+// remainingTTL returns the seconds left until the record expires, rounded
+// up so that a live record never reports zero, or defaultTTL if it never
+// expires.
+func (r record) remainingTTL(now time.Time, defaultTTL uint32) uint32 {
+	if r.expiry.IsZero() {
+		return defaultTTL
+	}
+	if r.expired(now) {
+		return 0
+	}
+	return uint32((r.expiry.Sub(now) + time.Second - 1) / time.Second)
+}
+
+// answer returns copies of the cached records with the given TTL, with the
+// owner name spelled the way the client asked for it.
+func (r record) answer(qname string, ttl uint32) []dns.RR {
+	rrs := make([]dns.RR, 0, len(r.rrs))
+	for _, rr := range r.rrs {
+		rr = dns.Copy(rr)
+		if strings.EqualFold(rr.Header().Name, qname) {
+			rr.Header().Name = qname
+		}
+		rr.Header().Ttl = ttl
+		rrs = append(rrs, rr)
+	}
+	return rrs
+}
+
 const IDNS_DEBUG = "IDNS_DEBUG"
 const DEBUG_PREFIX = "[DEBUG]"
 
-func isDebug() bool {
-	return os.Getenv(IDNS_DEBUG) == "1"
+// parseRecord parses the fields following the domain of a cache line. A
+// records are stored as plain addresses, other types as their mnemonic
+// followed by the base64 wire form of each record.
+func parseRecord(name string, fields []string) (uint16, record, error) {
+	rec := record{source: sourceCacheFile}
+	// entries written since TTLs are tracked carry the expiry as a unix
+	// timestamp before the data
+	if expiry, err := strconv.ParseInt(fields[0], 10, 64); err == nil {
+		rec.expiry = time.Unix(expiry, 0)
+		fields = fields[1:]
+	}
+	if len(fields) == 0 {
+		return 0, rec, fmt.Errorf("no data")
+	}
+	if qtype, ok := dns.StringToType[fields[0]]; ok {
+		for _, f := range fields[1:] {
+			wire, err := base64.StdEncoding.DecodeString(f)
+			if err != nil {
+				return 0, rec, err
+			}
+			rr, _, err := dns.UnpackRR(wire, 0)
+			if err != nil {
+				return 0, rec, err
+			}
+			rec.rrs = append(rec.rrs, rr)
+		}
+		return qtype, rec, nil
+	}
+	for _, f := range fields {
+		ip := net.ParseIP(f)
+		if ip == nil || ip.To4() == nil {
+			return 0, rec, fmt.Errorf("invalid address %s", f)
+		}
+		rec.rrs = append(rec.rrs, &dns.A{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET}, A: ip})
+	}
+	return dns.TypeA, rec, nil
+}
+
+func formatRecord(qtype uint16, rec record) string {
+	var fields []string
+	if !rec.expiry.IsZero() {
+		fields = append(fields, strconv.FormatInt(rec.expiry.Unix(), 10))
+	}
+	plain := qtype == dns.TypeA
+	for _, rr := range rec.rrs {
+		if _, ok := rr.(*dns.A); !ok {
+			plain = false
+		}
+	}
+	if plain {
+		for _, rr := range rec.rrs {
+			fields = append(fields, rr.(*dns.A).A.String())
+		}
+		return strings.Join(fields, " ")
+	}
+	fields = append(fields, dns.TypeToString[qtype])
+	for _, rr := range rec.rrs {
+		wire := make([]byte, dns.Len(rr))
+		n, err := dns.PackRR(rr, wire, 0, nil, false)
+		if err != nil {
+			continue
+		}
+		fields = append(fields, base64.StdEncoding.EncodeToString(wire[:n]))
+	}
+	return strings.Join(fields, " ")
 }
 
 func loadCache(cachePath string) {
@@ -44,7 +175,21 @@ func loadCache(cachePath string) {
 	}
 	defer file.Close()
 
-	scanner := bufio.NewScanner(file)
+	r := bufio.NewReader(file)
+	if isBinaryCache(r) {
+		err = readCacheBinary(r, records.set)
+	} else {
+		err = readCacheLines(r, records.set)
+	}
+	if err != nil {
+		log.Fatal("Error reading config file: ", err)
+	}
+}
+
+// readCacheLines calls fn for every record of r, in the format of the cache
+// file. Invalid lines are logged and skipped.
+func readCacheLines(r io.Reader, fn func(cacheKey, record)) error {
+	scanner := bufio.NewScanner(r)
 	for scanner.Scan() {
 		line := scanner.Text()
 		parts := strings.Split(line, " ")
@@ -52,210 +197,1585 @@ func loadCache(cachePath string) {
 			log.Printf("Invalid line in config file: %s", line)
 			continue
 		}
-		domain := parts[0]
-		ips := parts[1:]
-		updateRecords(domain, ips, "")
-	}
-
-	if err := scanner.Err(); err != nil {
-		log.Fatal("Error reading config file: ", err)
+		domain := strings.ToLower(parts[0])
+		qtype, rec, err := parseRecord(domain, parts[1:])
+		if err != nil {
+			log.Printf("Invalid line in config file: %s: %s", line, err)
+			continue
+		}
+		fn(cacheKey{domain, qtype}, rec)
 	}
+	return scanner.Err()
 }
 
+// saveCache writes the cache to a temporary file next to cachePath and
+// renames it into place, so that a crash never leaves a partial cache file.
+// The records are copied out of the cache first, so that queries are not
+// held up by the disk, and concurrent saves are serialized.
 func saveCache(cachePath string) {
-	file, err := os.Create(cachePath)
+	mutex.Lock()
+	defer mutex.Unlock()
+	entries := records.snapshot()
+	file, err := os.CreateTemp(filepath.Dir(cachePath), filepath.Base(cachePath)+".tmp*")
 	if err != nil {
 		log.Fatal("Failed to write config file: ", err)
 	}
+	defer os.Remove(file.Name())
 	defer file.Close()
-	for domain, ips := range records {
-		line := fmt.Sprintf("%s %s\n", domain, strings.Join(ips, " "))
-		_, err := file.WriteString(line)
-		if err != nil {
-			log.Fatal("Failed to write line to config file: ", err)
+	w := bufio.NewWriter(file)
+	if cacheFormat == "binary" {
+		err = writeCacheBinary(w, entries)
+	} else {
+		for _, e := range entries {
+			if !e.rec.servfail {
+				fmt.Fprintf(w, "%s %s\n", e.key.name, formatRecord(e.key.qtype, e.rec))
+			}
 		}
+		err = w.Flush()
+	}
+	if err != nil {
+		log.Fatal("Failed to write line to config file: ", err)
+	}
+	if err := file.Chmod(0644); err != nil {
+		log.Fatal("Failed to write config file: ", err)
+	}
+	if err := file.Sync(); err != nil {
+		log.Fatal("Failed to write config file: ", err)
+	}
+	if err := file.Close(); err != nil {
+		log.Fatal("Failed to write config file: ", err)
+	}
+	if err := os.Rename(file.Name(), cachePath); err != nil {
+		log.Fatal("Failed to write config file: ", err)
+	}
+}
+
+// flushCacheEvery writes the cache to cachePath about every interval, off by
+// up to a tenth of it so that instances started together spread their
+// writes, and does nothing when no record changed since the last write.
+func flushCacheEvery(cachePath string, interval time.Duration) {
+	for {
+		jitter := time.Duration(rand.Int63n(int64(interval/10) + 1))
+		time.Sleep(interval - interval/20 + jitter)
+		flushCache(cachePath)
+	}
+}
+
+func flushCache(cachePath string) {
+	if cacheDirty.Swap(false) {
+		saveCache(cachePath)
 	}
 }
 
-func fetchRecordFromUpsteams(name string, upstreams []string) []string {
+// randomizeCase applies DNS 0x20 encoding to name by flipping the case of
+// each letter at random.
+func randomizeCase(name string) string {
+	b := []byte(name)
+	for i, ch := range b {
+		if ('a' <= ch && ch <= 'z' || 'A' <= ch && ch <= 'Z') && rand.Intn(2) == 0 {
+			b[i] = ch ^ 0x20
+		}
+	}
+	return string(b)
+}
+
+// forwardedTypes are the query types resolved through the upstreams, others
+// are answered empty.
+var forwardedTypes = map[uint16]bool{
+	dns.TypeA:     true,
+	dns.TypeAAAA:  true,
+	dns.TypeSVCB:  true,
+	dns.TypeHTTPS: true,
+	dns.TypeSRV:   true,
+	// certificate authorities check CAA before issuing, an empty answer
+	// would allow any of them
+	dns.TypeCAA: true,
+}
+
+// upstreamAnswer is what an upstream returned for a query.
+type upstreamAnswer struct {
+	rrs  []dns.RR
+	ttl  uint32      // smallest TTL among the records
+	opts []dns.EDNS0 // relayed EDNS0 options of the response
+	// rcode of the response, telling NXDOMAIN apart from a name that
+	// merely has no records of the queried type
+	rcode  int
+	err    error  // why no upstream answered
+	source string // sourceUpstream or sourceDoH
+	// the SOA of the authority section of a negative response, telling
+	// clients how long to cache it (RFC 2308)
+	soa dns.RR
+	ad  bool // the AD bit of the response
+}
+
+// newUpstreamAnswer builds an answer from the answer section of a response,
+// including any CNAME chain leading to the records of the queried type.
+func newUpstreamAnswer(answer []dns.RR) upstreamAnswer {
+	var ua upstreamAnswer
+	for i, rr := range answer {
+		// names may carry the 0x20 casing of the query or the spelling of
+		// the upstream's zone, the cache keeps them lowercase and fully
+		// qualified so that they compare equal
+		rr.Header().Name = dns.CanonicalName(rr.Header().Name)
+		if cname, ok := rr.(*dns.CNAME); ok {
+			cname.Target = dns.CanonicalName(cname.Target)
+		}
+		if i == 0 || rr.Header().Ttl < ua.ttl {
+			ua.ttl = rr.Header().Ttl
+		}
+		ua.rrs = append(ua.rrs, rr)
+	}
+	return ua
+}
+
+// fetchRecordFromUpsteams queries the records of name, sending opts along in
+// the OPT record of the query.
+func (h *dnsHandler) fetchRecordFromUpsteams(ctx context.Context, name string, qtype uint16, list *upstreamList, opts []dns.EDNS0) upstreamAnswer {
 	var r *dns.Msg
 	var err error
-	c := new(dns.Client)
 	m := new(dns.Msg)
-	m.SetQuestion(dns.Fqdn(name), dns.TypeA)
+	qname := dns.Fqdn(name)
+	// upstreams only tell whether they validated the answer when asked
+	m.AuthenticatedData = h.adMode == "upstream"
+	if len(opts) > 0 {
+		m.SetEdns0(dns.DefaultMsgSize, false)
+		m.IsEdns0().Option = opts
+	}
+	upstreams := h.orderUpstreams(name, list)
 	for i, us := range upstreams {
-		r, _, err = c.Exchange(m, us)
+		if h.use0x20 {
+			qname = randomizeCase(dns.Fqdn(name))
+		}
+		m.SetQuestion(qname, qtype)
+		var rtt time.Duration
+		r, rtt, err = h.exchange(ctx, m, us)
+		h.upstreamStats.observe(us, rtt, err)
+		if h.logUpstreams {
+			logUpstreamQuery(name, qtype, us, rtt, r, err)
+		}
+		if err == nil && h.use0x20 && (len(r.Question) != 1 || r.Question[0].Name != qname) {
+			// the upstream did not echo back our exact casing, the answer
+			// may be spoofed
+			err = fmt.Errorf("0x20 mismatch in response question")
+			r = nil
+		}
 		if err != nil {
-			if i == len(upstreams)-1 {
+			// failing over is pointless once the query deadline passed
+			if i == len(upstreams)-1 || ctx.Err() != nil {
 				log.Printf("Error querying from upstreams: %s %s", name, err)
-				return nil
+				return upstreamAnswer{err: err}
 			}
 		} else {
 			if isDebug() {
 				fmt.Printf("[DEBUG] udp[%s] ", us)
 			}
+			if h.upstreamMode == "failover-sticky" {
+				list.stickTo(us)
+			}
 			break
 		}
 	}
 	if r == nil {
 		log.Println("No record found for", name)
-		return nil
+		return upstreamAnswer{err: errors.New("no upstreams")}
 	}
-	var ips []string
-	for _, answer := range r.Answer {
-		if a, ok := answer.(*dns.A); ok {
-			if isDebug() {
-				fmt.Printf(" %v \n", a)
-			}
-			ips = append(ips, a.A.String())
+	if isDebug() {
+		for _, rr := range r.Answer {
+			fmt.Printf(" %v \n", rr)
 		}
 	}
-
-	return ips
+	ua := newUpstreamAnswer(r.Answer)
+	ua.opts = h.relayedOptions(r)
+	ua.rcode = r.Rcode
+	ua.ad = r.AuthenticatedData
+	ua.source = sourceUpstream
+	for _, rr := range r.Ns {
+		if rr.Header().Rrtype == dns.TypeSOA {
+			ua.soa = rr
+			break
+		}
+	}
+	return ua
 }
 
-func fetchRecordFromDNSProviders(name string, upstreams []string) []string {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+// fetchRecordFromDNSProviders queries the records of name over DoH. The
+// JSON API of the providers carries no EDNS0 options, so opts are only sent
+// when falling back to plain upstreams.
+func (h *dnsHandler) fetchRecordFromDNSProviders(ctx context.Context, name string, qtype uint16, upstreams *upstreamList, opts []dns.EDNS0) upstreamAnswer {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
 	defer cancel()
-	// init doh client, auto select the fastest provider base on your like
-	// you can also use as: c := doh.Use(), it will select from all providers
-	c := doh.Use(doh.Quad9Provider, doh.CloudflareProvider, doh.GoogleProvider)
-	defer c.Close()
-	// do doh query
-	rsp, err := c.Query(ctx, hdns.Domain(name), hdns.TypeA)
+	rsp, err := h.queryDoH(ctx, name, qtype)
+	for attempt := 0; err != nil && attempt < h.dohRetries && transientDoHError(err); attempt++ {
+		delay := h.dohRetryDelay << attempt
+		if isDebug() {
+			log.Println(DEBUG_PREFIX, "retrying doh", name, "in", delay, err)
+		}
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		rsp, err = h.queryDoH(ctx, name, qtype)
+	}
+	var status dohStatusError
+	if errors.As(err, &status) && int(status) == dns.RcodeNameError {
+		return upstreamAnswer{rcode: dns.RcodeNameError}
+	}
 	if err != nil {
 		if isDebug() {
 			log.Println(DEBUG_PREFIX, name, err)
 		}
-		return fetchRecordFromUpsteams(name, upstreams)
+		return h.fetchRecordFromUpsteams(ctx, name, qtype, upstreams, opts)
 	}
-	// doh dns answer
-	answer := rsp.Answer
-	// print all answer
-	var ips []string
+	return dohAnswer(name, qtype, rsp)
+}
 
-	for _, a := range answer {
-		if isDebug() {
-			fmt.Printf("[DEBUG] doh %s -> %s\n", a.Name, a.Data)
+func (h *dnsHandler) queryDoH(ctx context.Context, name string, qtype uint16) (*hdns.Response, error) {
+	// the first provider to answer wins, with -doh-parallel the first to
+	// answer with records of qtype
+	return queryProviders(ctx, h.dohClients(), name, qtype, h.dohParallel)
+}
+
+func lookupRecord(name string, qtype uint16) (record, bool) {
+	key := cacheKey{name, qtype}
+	rec, ok := records.get(key)
+	if ok || disk == nil {
+		return rec, ok
+	}
+	rec, ok = disk.get(key)
+	if ok && records.bounded() {
+		// the memory cache only keeps the hot records of the database
+		// when -cache-size bounds it, not a copy of all of it
+		records.set(key, rec)
+	}
+	return rec, ok
+}
+
+// updateRecords caches the records of ua for name. The upstream ttl is
+// replaced by a configured override for name, if any.
+func (h *dnsHandler) updateRecords(name string, qtype uint16, ua upstreamAnswer) {
+	h.ttlStats.observe(qtype, ua.ttl)
+	if h.noCache {
+		return
+	}
+	ttl := h.effectiveTTL(name, ua.ttl)
+	key := cacheKey{name, qtype}
+	rec := record{rrs: ua.rrs, expiry: time.Now().Add(time.Duration(ttl) * time.Second), source: ua.source, authenticated: ua.ad}
+	if disk == nil || records.bounded() {
+		records.set(key, rec)
+	}
+	if disk != nil {
+		if err := disk.put(key, rec); err != nil {
+			log.Printf("Failed to write %s to the cache database: %s", name, err)
 		}
-		ips = append(ips, a.Data)
+	} else if h.cachePath != "" && h.cacheFlushInterval > 0 {
+		cacheDirty.Store(true)
+	} else if h.cachePath != "" {
+		saveCache(h.cachePath)
 	}
+}
 
-	return ips
+// cacheServfail remembers for -servfail-ttl that resolving name failed, so
+// that retrying clients do not hammer a struggling upstream. The next
+// successful resolution overwrites it. Failures are not remembered with a
+// database the memory cache does not bound, as those resolutions are only
+// written to the database and would never replace them.
+func (h *dnsHandler) cacheServfail(name string, qtype uint16) {
+	if h.noCache || h.servfailTTL <= 0 || (disk != nil && !records.bounded()) {
+		return
+	}
+	records.set(cacheKey{name, qtype}, record{expiry: time.Now().Add(h.servfailTTL), servfail: true})
 }
 
-func updateRecords(name string, ips []string, cachePath string) {
-	mutex.Lock()
-	records[name] = ips
-	if cachePath != "" {
-		saveCache(cachePath)
+// effectiveTTL applies the TTL policy to the TTL of an answer for name, the
+// upstream's or -default-ttl for answers made up locally.
+func (h *dnsHandler) effectiveTTL(name string, ttl uint32) uint32 {
+	if override, ok := h.ttlOverride(name); ok {
+		ttl = override
+	}
+	if max := uint32(h.maxCacheAge / time.Second); h.maxCacheAge > 0 && ttl > max {
+		ttl = max
 	}
-	mutex.Unlock()
+	return ttl
 }
 
-func (h *dnsHandler) parseQuery(m *dns.Msg) {
-	for _, q := range m.Question {
-		switch q.Qtype {
-		case dns.TypeA:
-			if isDebug() {
-				log.Printf("[DEBUG] query %s\n", q.Name)
+// servedTTL returns the TTL a cached record is answered with. It never goes
+// below -ttl-floor: clients told 0 would not cache the answer at all and
+// query again right away, all at once for a popular name about to expire.
+func (h *dnsHandler) servedTTL(rec record, now time.Time) uint32 {
+	ttl := rec.remainingTTL(now, h.defaultTTL)
+	if floor := uint32(h.ttlFloor / time.Second); ttl < floor {
+		ttl = floor
+	}
+	return ttl
+}
+
+// tooOld reports whether rec outlives -max-cache-age. Records are stored
+// with their TTL capped to the max age, so one that expires later than that
+// was cached before the limit applied, like entries of an older cache file.
+func (h *dnsHandler) tooOld(rec record, now time.Time) bool {
+	return h.maxCacheAge > 0 && (rec.expiry.IsZero() || rec.expiry.Sub(now) > h.maxCacheAge)
+}
+
+// ttlOverride returns the forced TTL of the closest listed parent of name.
+func (h *dnsHandler) ttlOverride(name string) (uint32, bool) {
+	name = strings.TrimSuffix(name, ".")
+	for name != "" {
+		if ttl, ok := h.ttlOverrides[name]; ok {
+			return ttl, true
+		}
+		i := strings.IndexByte(name, '.')
+		if i < 0 {
+			break
+		}
+		name = name[i+1:]
+	}
+	return 0, false
+}
+
+func (h *dnsHandler) parseTTLOverrides(path string) {
+	if path == "" {
+		return
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		log.Fatal("Failed to read ttl overrides file: ", err)
+	}
+	defer file.Close()
+	h.ttlOverrides = make(map[string]uint32)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.Fields(line)
+		if len(parts) != 2 {
+			log.Printf("Invalid line in ttl overrides file: %s", line)
+			continue
+		}
+		ttl, err := strconv.ParseUint(parts[1], 10, 32)
+		if err != nil {
+			log.Printf("Invalid ttl in ttl overrides file: %s", line)
+			continue
+		}
+		h.ttlOverrides[strings.TrimSuffix(strings.ToLower(parts[0]), ".")] = uint32(ttl)
+	}
+	if isDebug() {
+		log.Println("[DEBUG] TTL overrides:\n", h.ttlOverrides)
+	}
+}
+
+// request carries per-query state from ServeDNS down to the upstreams.
+type request struct {
+	opts      []dns.EDNS0   // EDNS0 options relayed to upstreams
+	upstreams *upstreamList // plain upstreams serving the client
+	do        bool          // the client asked for DNSSEC records
+	replyOpts []dns.EDNS0   // EDNS0 options relayed back from upstreams
+	soa       dns.RR        // of the last negative answer from upstreams
+	wantsAD   bool          // the client understands the AD bit (RFC 6840)
+	client    net.IP
+	budget    time.Time // when follow-up resolutions stop, zero for never
+	// some answer was made up or changed locally, or not validated by the
+	// upstreams, so the response must not claim to be authenticated
+	insecure bool
+	ede      *dns.EDNS0_EDE // why the answer is not the upstreams', if known
+}
+
+// followUp returns the context of a further resolution adding to what was
+// already resolved for the query, bounded by -query-budget, or false once
+// the budget is spent.
+func (req *request) followUp(ctx context.Context) (context.Context, context.CancelFunc, bool) {
+	if req.budget.IsZero() {
+		return ctx, func() {}, true
+	}
+	if req.overBudget() {
+		return nil, nil, false
+	}
+	ctx, cancel := context.WithDeadline(ctx, req.budget)
+	return ctx, cancel, true
+}
+
+func (req *request) overBudget() bool {
+	return !req.budget.IsZero() && !time.Now().Before(req.budget)
+}
+
+func logOverBudget(q dns.Question) {
+	log.Printf("Query budget spent on %s %s, answering with partial results", q.Name, dns.TypeToString[q.Qtype])
+}
+
+type requestKey struct{}
+
+func withRequest(ctx context.Context, req *request) context.Context {
+	return context.WithValue(ctx, requestKey{}, req)
+}
+
+// requestFrom returns the request ctx belongs to, or one served by the
+// default upstreams when there is none.
+func (h *dnsHandler) requestFrom(ctx context.Context) *request {
+	if req, ok := ctx.Value(requestKey{}).(*request); ok {
+		return req
+	}
+	return &request{upstreams: h.defaultUpstreams()}
+}
+
+func (h *dnsHandler) newRequest(w dns.ResponseWriter, r *dns.Msg) *request {
+	req := &request{
+		opts:      h.relayedOptions(r),
+		upstreams: h.listenerUpstreams(w.LocalAddr()),
+		do:        r.IsEdns0() != nil && r.IsEdns0().Do(),
+		client:    addrIP(w.RemoteAddr()),
+	}
+	req.wantsAD = r.AuthenticatedData || req.do
+	if h.queryBudget > 0 {
+		req.budget = time.Now().Add(h.queryBudget)
+	}
+	return req
+}
+
+// listenerUpstreams returns the upstream group configured for the local
+// address a query arrived on, matched by ip:port first and then by ip.
+func (h *dnsHandler) listenerUpstreams(addr net.Addr) *upstreamList {
+	conf := h.upstreamConfig()
+	if len(conf.byListener) > 0 && addr != nil {
+		if us, ok := conf.byListener[addr.String()]; ok {
+			return us
+		}
+		if host, _, err := net.SplitHostPort(addr.String()); err == nil {
+			if us, ok := conf.byListener[host]; ok {
+				return us
 			}
-			ips := records[q.Name]
-			if len(ips) == 0 {
-				if h.pacRules[q.Name] {
-					if isDebug() {
-						log.Println("[DEBUG] hit pac rule")
-					}
-					ips = fetchRecordFromDNSProviders(q.Name, h.pacUpstreams)
-				} else {
-					ips = fetchRecordFromUpsteams(q.Name, h.nonPacUpStreams)
+		}
+	}
+	return conf.plain
+}
+
+func (h *dnsHandler) parseQuery(ctx context.Context, m *dns.Msg) {
+	req := h.requestFrom(ctx)
+	ctx = withRequest(ctx, req)
+	for _, q := range m.Question {
+		req.soa = nil
+		answers, rcode, err := h.resolve(ctx, q.Name, q.Qtype)
+		if err != nil && isDebug() {
+			log.Println(DEBUG_PREFIX, "resolving", q.Name, err)
+		}
+		if err == nil {
+			answers, rcode = h.chaseCNAME(ctx, q, answers, rcode)
+		}
+		if h.dns64Prefix != nil && q.Qtype == dns.TypeAAAA && rcode == dns.RcodeSuccess && !h.ipv6Down.Load() && len(onlyType(answers, dns.TypeAAAA)) == 0 {
+			// the name has no IPv6 address, reach it through NAT64
+			if fctx, cancel, ok := req.followUp(ctx); !ok {
+				logOverBudget(q)
+			} else {
+				a, arcode, aerr := h.resolve(fctx, q.Name, dns.TypeA)
+				if aerr == nil {
+					a, arcode = h.chaseCNAME(fctx, dns.Question{Name: q.Name, Qtype: dns.TypeA, Qclass: dns.ClassINET}, a, arcode)
 				}
-				if len(ips) > 0 {
-					go updateRecords(q.Name, ips, h.cachePath)
+				cancel()
+				if req.overBudget() {
+					logOverBudget(q)
+				} else {
+					answers, rcode, err = synthesizeAAAA(h.dns64Prefix, a), arcode, aerr
+					req.insecure = true
 				}
 			}
-			for _, ip := range ips {
-				rr, err := dns.NewRR(fmt.Sprintf("%s A %s", q.Name, ip))
-				if err == nil {
-					m.Answer = append(m.Answer, rr)
-				}
+		}
+		if rcode != dns.RcodeSuccess {
+			m.Rcode = rcode
+		}
+		if h.clientShuffle && req.client != nil {
+			shuffleForClient(answers, q.Qtype, q.Name, req.client)
+		}
+		if h.minimalAnswers {
+			answers = onlyType(answers, q.Qtype)
+		}
+		if !req.do {
+			// DNSSEC records only go to clients able to validate them
+			answers = withoutDNSSEC(answers, q.Qtype)
+		}
+		if req.do && h.signer.covers(q.Name) {
+			req.insecure = true
+			var err error
+			if answers, err = h.signer.sign(answers); err != nil {
+				log.Printf("Failed to sign answer of %s: %s", q.Name, err)
+			}
+		}
+		if req.soa != nil && (rcode == dns.RcodeSuccess || rcode == dns.RcodeNameError) && len(onlyType(answers, q.Qtype)) == 0 {
+			// NODATA or NXDOMAIN, possibly at the end of a CNAME chain
+			m.Ns = append(m.Ns, req.soa)
+		}
+		if h.srvTargets && q.Qtype == dns.TypeSRV {
+			m.Extra = append(m.Extra, h.srvAdditionals(ctx, answers)...)
+		}
+		m.Answer = append(m.Answer, answers...)
+	}
+	if req.ede != nil {
+		// ahead of the options of upstreams, which may carry one too
+		addOptions(m, []dns.EDNS0{req.ede})
+	}
+	addOptions(m, req.replyOpts)
+	if h.adMode == "upstream" && req.wantsAD && !req.insecure && (m.Rcode == dns.RcodeSuccess || m.Rcode == dns.RcodeNameError) {
+		// every answer was validated by upstreams trusted to do so
+		m.AuthenticatedData = true
+	}
+	if h.minimalAnswers {
+		m.Ns = nil
+		m.Extra = onlyType(m.Extra, dns.TypeOPT)
+	}
+}
+
+// onlyType returns the records of rrs having type qtype.
+func onlyType(rrs []dns.RR, qtype uint16) []dns.RR {
+	var kept []dns.RR
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == qtype {
+			kept = append(kept, rr)
+		}
+	}
+	return kept
+}
+
+// withoutDNSSEC drops the RRSIG, NSEC and NSEC3 records of rrs, as RFC 4035
+// requires for clients not setting the DO bit, unless qtype asks for them.
+func withoutDNSSEC(rrs []dns.RR, qtype uint16) []dns.RR {
+	var kept []dns.RR
+	for _, rr := range rrs {
+		switch t := rr.Header().Rrtype; t {
+		case dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3:
+			if t != qtype {
+				continue
+			}
+		}
+		kept = append(kept, rr)
+	}
+	return kept
+}
+
+// fetch queries name from the upstreams selected by the PAC rules.
+func (h *dnsHandler) fetch(ctx context.Context, name string, qtype uint16, req *request) upstreamAnswer {
+	if h.mdnsSuffix != "" && dns.IsSubDomain(h.mdnsSuffix, name) {
+		return h.fetchMDNS(ctx, name, qtype)
+	}
+	if h.pacMode == "direct-listed" {
+		// the pac lists the exceptions, everything else goes over DoH
+		if h.hasPacRule(name) {
+			if isDebug() {
+				log.Println("[DEBUG] hit pac rule, resolving directly")
 			}
+			return h.fetchRecordFromUpsteams(ctx, name, qtype, req.upstreams, req.opts)
+		}
+		return h.fetchRecordFromDNSProviders(ctx, name, qtype, h.upstreamConfig().pac, req.opts)
+	}
+	if h.hasPacRule(name) {
+		if isDebug() {
+			log.Println("[DEBUG] hit pac rule")
 		}
+		return h.fetchRecordFromDNSProviders(ctx, name, qtype, h.upstreamConfig().pac, req.opts)
 	}
+	switch h.pacDefault {
+	case "doh":
+		return h.fetchRecordFromDNSProviders(ctx, name, qtype, req.upstreams, req.opts)
+	case "block":
+		if isDebug() {
+			log.Println("[DEBUG] no pac rule, blocked", name)
+		}
+		return upstreamAnswer{rcode: dns.RcodeNameError}
+	}
+	return h.fetchRecordFromUpsteams(ctx, name, qtype, req.upstreams, req.opts)
+}
+
+// resolve answers the records of type qtype of qname from the hosts, the
+// cache or the upstreams, caching what is fetched, and passes them through
+// the rewriters. The request the query belongs to is taken from ctx. The
+// error is only set when no upstream could be reached, the records and
+// rcode are usable either way.
+func (h *dnsHandler) resolve(ctx context.Context, qname string, qtype uint16) ([]dns.RR, int, error) {
+	if h.viaHints {
+		if name, upstream, ok := viaHint(qname); ok {
+			h.requestFrom(ctx).insecure = true
+			return h.resolveVia(ctx, qname, name, qtype, upstream)
+		}
+	}
+	normalized := normalizeName(qname)
+	if !validName(normalized) {
+		// malformed names are not worth asking the upstreams about
+		return nil, dns.RcodeFormatError, nil
+	}
+	answers, rcode, err := h.answer(ctx, normalized, qtype)
+	if normalized != qname {
+		// answer in the spelling of the question
+		for _, rr := range answers {
+			if strings.EqualFold(rr.Header().Name, normalized) {
+				rr.Header().Name = qname
+			}
+		}
+	}
+	q := dns.Question{Name: qname, Qtype: qtype, Qclass: dns.ClassINET}
+	for _, rw := range h.rewriters {
+		answers = rw(q, answers)
+	}
+	if len(h.rewriters) > 0 {
+		// what the rewriters return is not what the upstreams validated
+		h.requestFrom(ctx).insecure = true
+	}
+	return answers, rcode, err
+}
+
+// answer returns the records of type qtype of qname, a normalized name,
+// with its rcode: from the response policy, the blocklist, the hosts and
+// regex rules, the cache or else the upstreams, caching what they answer.
+// The error is set when no upstream could be reached.
+func (h *dnsHandler) answer(ctx context.Context, qname string, qtype uint16) ([]dns.RR, int, error) {
+	req := h.requestFrom(ctx)
+	// only validated answers from the upstreams keep the response secure
+	authenticated := false
+	defer func() {
+		if !authenticated {
+			req.insecure = true
+		}
+	}()
+	// names are case-insensitive, key everything on the lowercase form
+	name := strings.ToLower(qname)
+	if qtype == dns.TypeDNSKEY && h.signer != nil && name == h.signer.zone {
+		return h.signer.dnskey(h.effectiveTTL(name, h.defaultTTL)), dns.RcodeSuccess, nil
+	}
+	if !forwardedTypes[qtype] {
+		return nil, dns.RcodeSuccess, nil
+	}
+	if isDebug() {
+		log.Printf("[DEBUG] query %s %s\n", qname, dns.TypeToString[qtype])
+	}
+	rule, hasPolicy := h.responsePolicy().lookup(name)
+	if hasPolicy && isDebug() {
+		log.Println("[DEBUG] response policy", rule.action, "for", name)
+	}
+	switch {
+	case hasPolicy && rule.action == policyNXDOMAIN:
+		req.setExtendedError(dns.ExtendedErrorCodeBlocked, "response policy")
+		return nil, dns.RcodeNameError, nil
+	case hasPolicy && rule.action == policyNODATA:
+		req.setExtendedError(dns.ExtendedErrorCodeBlocked, "response policy")
+		return nil, dns.RcodeSuccess, nil
+	case hasPolicy && rule.action == policyLocal:
+		req.setExtendedError(dns.ExtendedErrorCodeForgedAnswer, "response policy")
+		return rule.answer(qname, qtype), dns.RcodeSuccess, nil
+	case hasPolicy && rule.action == policyPassthru:
+		// resolved as usual, whatever the blocklist says
+	case h.blocked(name):
+		if isDebug() {
+			log.Println("[DEBUG] blocked", name)
+		}
+		req.setExtendedError(dns.ExtendedErrorCodeBlocked, "blocklist")
+		return nil, dns.RcodeNameError, nil
+	}
+	if qtype == dns.TypeAAAA && h.ipv6Down.Load() {
+		return nil, dns.RcodeSuccess, nil
+	}
+	// a pinned name is authoritative for every type, so an A-only pin
+	// answers AAAA (or HTTPS) with NODATA instead of forwarding
+	if pinned, ok := h.hosts.lookup(name); ok {
+		q := dns.Question{Name: qname, Qtype: qtype, Qclass: dns.ClassINET}
+		return pinnedRRs(q, pinned, h.effectiveTTL(name, h.defaultTTL)), dns.RcodeSuccess, nil
+	}
+	if rule, ok := h.regexRules().lookup(name); ok {
+		if isDebug() {
+			log.Println(DEBUG_PREFIX, "regex rule", rule.pattern, "for", name)
+		}
+		q := dns.Question{Name: qname, Qtype: qtype, Qclass: dns.ClassINET}
+		return rule.answer(q, h.effectiveTTL(name, h.defaultTTL)), dns.RcodeSuccess, nil
+	}
+	now := time.Now()
+	var rec record
+	var ok bool
+	if !h.noCache {
+		rec, ok = lookupRecord(name, qtype)
+	}
+	if ok && rec.servfail && !rec.expired(now) {
+		h.domainStats.record(name, true)
+		req.setExtendedError(dns.ExtendedErrorCodeCachedError, "upstreams failed recently")
+		return nil, dns.RcodeServerFailure, nil
+	}
+	if ok && len(rec.rrs) > 0 && !rec.expired(now) && !h.tooOld(rec, now) {
+		// clients see the TTL counting down while the record is cached
+		h.domainStats.record(name, true)
+		authenticated = rec.authenticated
+		return rec.answer(qname, h.servedTTL(rec, now)), dns.RcodeSuccess, nil
+	}
+	h.domainStats.record(name, false)
+	ua, shared := h.flights.do(ctx, h.flightKey(name, qtype, req), func() upstreamAnswer {
+		return h.fetch(ctx, name, qtype, req)
+	})
+	req.replyOpts = append(req.replyOpts, ua.opts...)
+	if ua.err != nil || ua.rcode == dns.RcodeServerFailure {
+		if h.serveStaleOnError && ok && len(rec.rrs) > 0 {
+			// a last resort, not caching the failure keeps the records
+			// around for the rest of the outage
+			log.Printf("Upstreams failed for %s %s, serving expired records (-serve-stale-on-error)", name, dns.TypeToString[qtype])
+			req.setExtendedError(dns.ExtendedErrorCodeStaleAnswer, "upstreams failed")
+			return rec.answer(qname, h.servedTTL(rec, time.Now())), dns.RcodeSuccess, nil
+		}
+		if !shared {
+			h.cacheServfail(name, qtype)
+		}
+		if ua.err != nil {
+			req.setExtendedError(dns.ExtendedErrorCodeNetworkError, "no upstream answered")
+		}
+		return nil, dns.RcodeServerFailure, ua.err
+	}
+	rcode := dns.RcodeSuccess
+	if ua.rcode == dns.RcodeNameError {
+		rcode = dns.RcodeNameError
+	}
+	authenticated = ua.ad
+	if !ua.hasType(qtype) {
+		// NODATA or NXDOMAIN, possibly of the target of a CNAME chain
+		// answered along
+		req.soa = ua.soa
+	}
+	if len(ua.rrs) == 0 {
+		return nil, rcode, ua.err
+	}
+	rec = record{rrs: ua.rrs}
+	if !shared {
+		// counted in flight, so that draining waits for the cache write
+		h.inflight.Add(1)
+		go func() {
+			defer h.inflight.Done()
+			h.updateRecords(name, qtype, ua)
+		}()
+	}
+	return rec.answer(qname, h.effectiveTTL(name, ua.ttl)), rcode, nil
 }
 
 type dnsHandler struct {
-	pacUpstreams    []string
+	upstreams       atomic.Pointer[upstreamConfig]
 	cachePath       string
+	pacMu           sync.RWMutex
 	pacRules        map[string]bool
-	nonPacUpStreams []string
+	use0x20         bool
+	hosts           *hostsTable
+	listsMu         sync.RWMutex
+	blocklist       *hostsTable
+	allowlist       *hostsTable // names never blocked
+	policy          *responsePolicy
+	refuseAny       bool
+	allowedClients  []*net.IPNet
+	ttlOverrides    map[string]uint32
+	rewriters       []AnswerMiddleware
+	ednsPassthrough map[uint16]bool
+	nsid            string
+	dohParallel     bool
+	ipv6Down        atomic.Bool
+	minimalAnswers  bool
+	dohRetries      int
+	dohRetryDelay   time.Duration
+	noCache         bool
+	domainStats     *domainStats
+	ttlStats        *ttlHistogram
+	pacDefault      string // how names without a pac rule are resolved
+	pacMode         string
+	signer          *zoneSigner // signs answers within -sign-zone
+	upstreamMode    string
+	padding         int // block size queries to tls:// upstreams are padded to
+	maxCacheAge     time.Duration
+	servfailTTL     time.Duration
+	ttlFloor        time.Duration // lowest TTL cached records are served with
+	defaultTTL      uint32        // TTL of answers no upstream gave one to
+	dns64Prefix     *net.IPNet    // NAT64 prefix AAAA records are synthesized in
+	queryTimeout    time.Duration
+	queryBudget     time.Duration // after which a query is answered with what it has
+	flights         *coalescer
+	// how long each upstream gets before failing over to the next
+	perUpstreamTimeout time.Duration
+	upstreamStats      *upstreamStats
+	logUpstreams       bool // log every upstream query as JSON
+	clientShuffle      bool
+	queryLog           *queryLog
+	mdnsSuffix         string // names resolved over multicast DNS
+	// compress names in answers: smaller messages, truncated less often, at
+	// the cost of some CPU and of clients mishandling compression pointers
+	compress bool
+	proxy    proxy.ContextDialer // SOCKS5 proxy upstream queries go through
+	// carries the queries of the DoH providers through proxy, nil without
+	dohTransport http.RoundTripper
+	viaHints     bool // answer name.via.a-b-c-d from that upstream
+	// where dynamic updates from updateClients are forwarded to
+	updateUpstream string
+	updateClients  []*net.IPNet
+	// write the cache file this often rather than on every update
+	cacheFlushInterval time.Duration
+	// names the certificates of tls:// upstreams are verified for, and the
+	// hashes of the public keys they are pinned to, by address
+	tlsServerNames map[string]string
+	tlsPins        map[string][][]byte
+	injectDelay    time.Duration // added to every answer, for testing only
+	srvTargets     bool          // resolve SRV targets into the additional section
+	quota          *clientQuota
+	// answer with expired records when no upstream does
+	serveStaleOnError bool
+	adMode            string // "clear" or "upstream"
+	regexes           regexRules
+	transportStats    transportStats
+	inflight          sync.WaitGroup // queries being answered and their cache writes, for draining
 }
 
-func (h *dnsHandler) parsePacFile(pacPath string) {
-	if pacPath == "" {
+func (h *dnsHandler) parsePacFile(src RuleSource) {
+	if src == nil {
 		return
 	}
-	file, err := os.Open(pacPath)
+	rules, err := readPac(src)
 	if err != nil {
-		if os.IsNotExist(err) {
-			log.Println("pac file is not found.")
+		log.Fatal("Failed to read pac file: ", err)
+	}
+	h.setPacRules(rules)
+}
+
+func loadHostsFile(kind, path string) *hostsTable {
+	if path == "" {
+		return nil
+	}
+	if err := checkNotDir(kind, path); err != nil {
+		log.Fatal(err)
+	}
+	start := time.Now()
+	t, err := loadHostsTable(path)
+	if err != nil {
+		log.Fatalf("Failed to read %s file: %s", kind, err)
+	}
+	log.Printf("Loaded %d %s entries in %s", t.len(), kind, time.Since(start))
+	return t
+}
+
+// parseUpstreams parses a comma separated list of host:port upstreams,
+// ignoring blank entries. An upstream may be suffixed with |weight, which
+// is recorded in weights.
+func parseUpstreams(list string, weights map[string]int) ([]string, error) {
+	var upstreams []string
+	for _, us := range strings.Split(list, ",") {
+		us = strings.TrimSpace(us)
+		if us == "" {
+			continue
 		}
-		return
+		if addr, weight, ok := strings.Cut(us, "|"); ok {
+			w, err := strconv.Atoi(weight)
+			if err != nil || w < 1 {
+				return nil, fmt.Errorf("%q has an invalid weight", us)
+			}
+			us = addr
+			weights[us] = w
+		}
+		host, port, err := net.SplitHostPort(strings.TrimPrefix(us, tlsScheme))
+		if err != nil {
+			return nil, fmt.Errorf("%q is not [tls://]host:port", us)
+		}
+		if host == "" {
+			return nil, fmt.Errorf("%q has no host", us)
+		}
+		if n, err := strconv.ParseUint(port, 10, 16); err != nil || n == 0 {
+			return nil, fmt.Errorf("%q has an invalid port", us)
+		}
+		upstreams = append(upstreams, us)
 	}
-	defer file.Close()
-	h.pacRules = make(map[string]bool)
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-		h.pacRules[line+"."] = true
+	if len(upstreams) == 0 {
+		return nil, fmt.Errorf("no upstreams given")
 	}
-	if isDebug() {
-		log.Println("[DEBUG] PAC rules:\n", h.pacRules)
+	return upstreams, nil
+}
+
+// parseCIDRs parses a comma separated list of networks, bare addresses are
+// treated as single host networks.
+func parseCIDRs(list string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			if ip := net.ParseIP(s); ip != nil && ip.To4() != nil {
+				s += "/32"
+			} else {
+				s += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// addrIP returns the IP address of a client address, nil if it has none.
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP
+	case *net.TCPAddr:
+		return a.IP
+	}
+	return nil
+}
+
+func (h *dnsHandler) clientAllowed(addr net.Addr) bool {
+	if len(h.allowedClients) == 0 {
+		return true
+	}
+	ip := addrIP(addr)
+	for _, n := range h.allowedClients {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// shouldRefuse reports whether a query matches a pattern commonly abused for
+// amplification and must be answered with REFUSED.
+func (h *dnsHandler) shouldRefuse(w dns.ResponseWriter, r *dns.Msg) bool {
+	if !h.clientAllowed(w.RemoteAddr()) {
+		return true
 	}
+	if h.refuseAny {
+		for _, q := range r.Question {
+			if q.Qtype == dns.TypeANY {
+				return true
+			}
+		}
+	}
+	return !h.quota.allow(addrIP(w.RemoteAddr()), time.Now())
 }
 
 func (h *dnsHandler) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	h.inflight.Add(1)
+	defer h.inflight.Done()
+	start := time.Now()
+	if h.injectDelay > 0 {
+		// slow every answer down, to test how clients time out
+		time.Sleep(h.injectDelay)
+	}
 	m := new(dns.Msg)
 	m.SetReply(r)
-	m.Compress = false
+	m.Compress = h.compress
+
+	if h.shouldRefuse(w, r) {
+		if isDebug() {
+			log.Println(DEBUG_PREFIX, "refused query from", w.RemoteAddr())
+		}
+		m.Rcode = dns.RcodeRefused
+		w.WriteMsg(m)
+		h.queryLog.log(w.RemoteAddr(), r, m, time.Since(start))
+		h.transportStats.observe(transportOf(w), time.Since(start))
+		return
+	}
 
-	switch r.Opcode {
-	case dns.OpcodeQuery:
-		h.parseQuery(m)
+	if opt := r.IsEdns0(); opt != nil {
+		m.SetEdns0(dns.DefaultMsgSize, opt.Do())
+		h.answerNSID(r, m)
 	}
 
+	switch {
+	case r.Opcode == dns.OpcodeQuery && len(r.Question) != 1:
+		// like other resolvers, answer exactly one question. dns.Server
+		// already rejects other counts by default, this keeps the handler
+		// correct with a custom MsgAcceptFunc (SetReply would only echo
+		// the first question)
+		m.Rcode = dns.RcodeFormatError
+	case r.Opcode == dns.OpcodeQuery:
+		ctx := context.Background()
+		if h.queryTimeout > 0 {
+			// give up on upstreams too slow for the client to still be
+			// waiting for the answer
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, h.queryTimeout)
+			defer cancel()
+		}
+		h.parseQuery(withRequest(ctx, h.newRequest(w, r)), m)
+	case r.Opcode == dns.OpcodeUpdate:
+		m = h.forwardUpdate(w.RemoteAddr(), r, m)
+	}
+
+	if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+		// answers beyond what the client can receive over UDP are cut
+		// short with the TC bit set, rather than fragmented or dropped
+		size := dns.MinMsgSize
+		if opt := r.IsEdns0(); opt != nil {
+			size = int(opt.UDPSize())
+		}
+		m.Truncate(size)
+	}
 	w.WriteMsg(m)
+	h.queryLog.log(w.RemoteAddr(), r, m, time.Since(start))
+	h.transportStats.observe(transportOf(w), time.Since(start))
+}
+
+// applyEnv sets every flag not given on the command line from its IDNS_
+// prefixed environment variable, e.g. -cache-backend from IDNS_CACHE_BACKEND.
+func applyEnv(fs *flag.FlagSet) error {
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if set[f.Name] || err != nil {
+			return
+		}
+		key := "IDNS_" + strings.ToUpper(strings.ReplaceAll(f.Name, "-", "_"))
+		if v, ok := os.LookupEnv(key); ok {
+			if e := fs.Set(f.Name, v); e != nil {
+				err = fmt.Errorf("%s: %s", key, e)
+			}
+		}
+	})
+	return err
 }
 
 func main() {
-	var cachePath, addr, pacPath, upStreams string
-	flag.StringVar(&addr, "addr", ":5353", "Address for DNS server") // Allow user to specify port via command line
-	flag.StringVar(&pacPath, "pac", "", "The file path to pac")
+	if len(os.Args) > 1 && os.Args[1] == "bench" {
+		runBench(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "test-upstreams" {
+		runTestUpstreams(os.Args[2:])
+		return
+	}
+
+	var cachePath, addr, pacPath, upStreams, hostsPath, blocklistPath, allowClients, ttlOverridesPath, remapPath, ednsPassthrough, nsid, cacheBackend, warmupPath, listenerUpstreamsPath, pacURL, metricsAddr, pacDefault, pacMode, signZone, signKey, upstreamMode, pidfile, restAddr, dns64Prefix, privateAllowPath, allowlistPath, resolvConf, adminAddr, responsePolicyPath, queryLogPath, mdnsSuffix, pacUpstreams, upstreamsFile, updateUpstream, updateClients, dohAddr, dohCert, dohKey, proxyURL, tlsServerNames, tlsPins, adMode, logLevelFlag, regexRulesPath string
+	var warmupWorkers, dohRetries, cacheShards, cacheSize, domainStatsSize, padding, queryLogMaxSize, queryLogMaxFiles, udpRcvbuf, udpSndbuf, clientQuotaLimit int
+	var use0x20, refuseAny, dohParallel, dropAAAA, minimalAnswers, check, noCache, serveTCP, dns64, noPrivateAnswers, logUpstreams, clientShuffle, mdns, compress, pipe, once, viaHints, srvTargets, serveStaleOnError, compressCache bool
+	var ipv6ProbeTarget string
+	var ipv6ProbeInterval, dohRetryDelay, pacRefresh, domainStatsDecay, maxCacheAge, servfailTTL, queryTimeout, coalesceWindow, perUpstreamTimeout, ttlFloor, defaultTTL, queryBudget, rulesRefresh, cacheFlushInterval, injectDelay, shutdownTimeout time.Duration
+	flag.StringVar(&addr, "addr", ":5353", "Comma separated addresses for DNS server") // Allow user to specify port via command line
+	flag.StringVar(&pacPath, "pac", "", "Comma separated file paths to pac, a directory standing for all files in it, merged and reloaded on SIGHUP, or the set of a redis://[:password@]host[:port][/db]?key=name URL holding one rule per member")
 	flag.StringVar(&cachePath, "cache", "", "The file path to pac")
-	flag.StringVar(&upStreams, "upstreams", "114.114.114.114:53,8.8.8.8:53", "dns upstreams for domains are not in pac")
+	flag.StringVar(&upStreams, "upstreams", defaultUpstreamList, "dns upstreams for domains are not in pac, prefixed with tls:// for DNS over TLS and suffixed with |weight to start from them proportionally more often")
+	flag.StringVar(&hostsPath, "hosts", "", "The file path to a hosts file pinning names to addresses")
+	flag.StringVar(&blocklistPath, "blocklist", "", "The file path to a list of domains answered with NXDOMAIN, optionally only during time ranges like 22:00-06:00, or a redis:// URL like -pac")
+	flag.BoolVar(&use0x20, "0x20", false, "randomize the case of names queried from upstreams and verify the echoed question")
+	flag.BoolVar(&refuseAny, "refuse-any", false, "respond REFUSED to ANY queries")
+	flag.StringVar(&allowClients, "allow", "", "comma separated client networks allowed to query, all others are REFUSED")
+	flag.StringVar(&updateUpstream, "update-upstream", "", "host:port of the primary server dynamic updates (UPDATE) are forwarded to over TCP")
+	flag.StringVar(&updateClients, "update-allow", "", "comma separated client networks allowed to send updates to -update-upstream, all others are REFUSED")
+	flag.StringVar(&ttlOverridesPath, "ttl-overrides", "", "The file path to per-domain TTL overrides, one \"domain ttl\" per line")
+	flag.StringVar(&remapPath, "remap", "", "The file path to address rewrites, one \"from-ip to-ip\" per line")
+	flag.StringVar(&ednsPassthrough, "edns-passthrough", "", "comma separated EDNS0 option codes relayed between clients and upstreams, e.g. 3,12")
+	flag.StringVar(&nsid, "nsid", "", "server identifier returned to clients requesting NSID")
+	flag.BoolVar(&compressCache, "compress-cache", false, "keep cached records in wire form with compressed names, about a third of the memory for a microsecond more per cache hit")
+	flag.StringVar(&cacheFormat, "cache-format", "text", "how the file backend writes -cache: \"text\" lines or a compact \"binary\" form, either is read")
+	flag.StringVar(&cacheBackend, "cache-backend", "file", "how -cache is stored: \"file\" loaded into memory at startup, or \"bolt\" read on demand, with -cache-size records kept in memory")
+	flag.BoolVar(&dohParallel, "doh-parallel", false, "query all DoH providers at once and use the first valid answer")
+	flag.StringVar(&warmupPath, "warmup", "", "The file path to domains resolved into the cache before serving, - for stdin")
+	flag.BoolVar(&once, "once", false, "resolve the -warmup domains (stdin by default) into the cache, save it and exit without serving")
+	flag.IntVar(&warmupWorkers, "warmup-workers", 8, "number of concurrent warm-up queries")
+	flag.BoolVar(&dropAAAA, "drop-aaaa-on-v4-only", false, "probe IPv6 reachability and answer AAAA queries with NODATA while it is down")
+	flag.StringVar(&ipv6ProbeTarget, "ipv6-probe", "[2001:4860:4860::8888]:53", "IPv6 address connected to by the reachability probe")
+	flag.DurationVar(&ipv6ProbeInterval, "ipv6-probe-interval", time.Minute, "interval between IPv6 reachability probes")
+	flag.StringVar(&listenerUpstreamsPath, "listener-upstreams", "", "The file path to upstreams per local address, one \"ip[:port] upstream,...\" per line, reloaded on SIGHUP")
+	flag.StringVar(&pacUpstreams, "pac-upstreams", defaultPacUpstreamList, "dns upstreams for domains in pac when the DNS over HTTPS providers fail")
+	flag.StringVar(&upstreamsFile, "upstreams-file", "", "The file path to \"upstreams list\" and \"pac-upstreams list\" lines overriding the flags, reloaded on SIGHUP")
+	flag.BoolVar(&minimalAnswers, "minimal-answers", false, "return only answer records of the queried type, dropping CNAME chains, authority and additional records")
+	flag.IntVar(&dohRetries, "doh-retries", 0, "number of retries of DoH queries failing transiently before falling back to plain upstreams")
+	flag.DurationVar(&dohRetryDelay, "doh-retry-delay", 200*time.Millisecond, "delay before the first DoH retry, doubled on every further retry")
+	flag.BoolVar(&check, "check", false, "validate the configuration, print a summary and exit")
+	flag.BoolVar(&pipe, "pipe", false, "resolve one wire format query read from stdin, write the wire format answer to stdout and exit, without listening")
+	flag.IntVar(&cacheShards, "cache-shards", 1, "number of independently locked cache shards")
+	flag.IntVar(&cacheSize, "cache-size", 0, "maximum number of records in the memory cache, evicting expired then least recently used ones, 0 for no limit")
+	flag.BoolVar(&noCache, "no-cache", false, "disable caching, every query is resolved from the upstreams and -cache is ignored")
+	flag.StringVar(&pacURL, "pac-url", "", "URL to fetch the pac rules from instead of -pac, either http(s)://... or txt:<name> for TXT records")
+	flag.DurationVar(&pacRefresh, "pac-refresh", time.Hour, "interval between refreshes of -pac-url")
+	flag.DurationVar(&rulesRefresh, "rules-refresh", 0, "interval between reloads of -pac, -blocklist and -allowlist on top of SIGHUP, meant for redis:// sources, disabled when 0")
+	flag.StringVar(&pacDefault, "pac-default", "upstream", "how names without a pac rule are resolved: \"upstream\" over -upstreams, \"doh\" over DoH, or \"block\" with NXDOMAIN")
+	flag.StringVar(&pacMode, "pac-mode", "doh-listed", "meaning of the pac rules: \"doh-listed\" resolves listed names over DoH, \"direct-listed\" resolves listed names over -upstreams and everything else over DoH, ignoring -pac-default")
+	flag.StringVar(&signZone, "sign-zone", "", "zone whose answers are signed with -sign-key for clients setting the DO bit")
+	flag.StringVar(&signKey, "sign-key", "", "path prefix of the BIND format .key and .private files of the -sign-zone key")
+	flag.BoolVar(&srvTargets, "srv-targets", false, "add the A and AAAA records of the targets of SRV answers to the additional section")
+	flag.StringVar(&logLevelFlag, "log-level", "info", "\"info\" or \"debug\", the level IDNS_DEBUG=1 also selects; SIGUSR2 cycles through the levels on unix systems and the admin API sets them at runtime")
+	flag.StringVar(&adMode, "ad-bit", "clear", "the AD bit of answers: \"clear\" never sets it, \"upstream\" sets it for clients asking (AD or DO) when every answer comes unchanged from upstreams that validated it, which they must be trusted to")
+	flag.StringVar(&upstreamMode, "upstream-mode", "order", "how upstreams are picked: \"order\" tries them as listed, \"hash\" picks one per name by consistent hashing, \"fastest\" prefers the fastest lately, \"failover-sticky\" keeps using the last one that answered, each failing over to the next")
+	flag.StringVar(&pidfile, "pidfile", "", "The file path the process id is written to while serving")
+	flag.BoolVar(&viaHints, "via-hints", false, "for debugging, resolve names like example.com.via.8-8-8-8 from the upstream they name; lets clients make idns query any address")
+	flag.StringVar(&proxyURL, "proxy", "", "socks5://[user:password@]host:port proxy upstreams and DoH providers are queried through, over TCP since UDP is not relayed")
+	flag.StringVar(&dohAddr, "doh-addr", "", "address of the DNS over HTTPS server answering at /dns-query, disabled when empty")
+	flag.StringVar(&dohCert, "doh-cert", "", "certificate file of -doh-addr, which serves plain HTTP without one")
+	flag.StringVar(&dohKey, "doh-key", "", "private key file of -doh-cert")
+	flag.StringVar(&restAddr, "rest-addr", "", "address of the HTTP server answering GET /resolve?name=...&type=... with JSON, disabled when empty")
+	flag.IntVar(&clientQuotaLimit, "client-quota", 0, "queries a client may send per day, refused beyond until local midnight, 0 for no limit")
+	flag.IntVar(&udpRcvbuf, "udp-rcvbuf", 0, "receive buffer size in bytes of the UDP sockets (SO_RCVBUF), the system default when 0")
+	flag.IntVar(&udpSndbuf, "udp-sndbuf", 0, "send buffer size in bytes of the UDP sockets (SO_SNDBUF), the system default when 0")
+	flag.StringVar(&tlsServerNames, "upstream-tls-servername", "", "comma separated host:port@name of tls:// upstreams whose certificate is verified for name rather than host, like 1.1.1.1:853@cloudflare-dns.com")
+	flag.StringVar(&tlsPins, "upstream-tls-pin", "", "comma separated host:port@pin of tls:// upstreams refused unless a certificate they present has the public key of a pin, the base64 SHA-256 of its SPKI; an upstream may have several pins. DoH providers are never pinned: their client builds its own TLS transport for every query")
+	flag.IntVar(&padding, "padding", 128, "pad queries to tls:// upstreams to a multiple of this many bytes (RFC 8467), 0 disables padding")
+	flag.DurationVar(&maxCacheAge, "max-cache-age", 0, "refresh cached records after this long whatever their TTL, which is capped to it, 0 for no limit")
+	flag.BoolVar(&serveTCP, "tcp", true, "also serve DNS over TCP on -addr, used by clients to retry truncated UDP answers")
+	flag.DurationVar(&shutdownTimeout, "shutdown-timeout", 5*time.Second, "how long to wait on SIGTERM or SIGINT for the queries in flight to be answered before exiting, new ones being refused meanwhile")
+	flag.DurationVar(&cacheFlushInterval, "cache-flush-interval", 0, "write the -cache file about this often, with some jitter, when records changed, instead of on every update, losing at most one interval of them on a crash; 0 writes on every update")
+	flag.DurationVar(&injectDelay, "inject-delay", 0, "TESTING ONLY, unsafe in production: delay every answer by this long to exercise client timeouts")
+	flag.BoolVar(&serveStaleOnError, "serve-stale-on-error", false, "answer with expired cached records rather than SERVFAIL when no upstream answers, with a TTL of -ttl-floor")
+	flag.DurationVar(&servfailTTL, "servfail-ttl", 5*time.Second, "how long failures to resolve a name are cached and answered with SERVFAIL, 0 disables it")
+	flag.DurationVar(&defaultTTL, "default-ttl", time.Hour, "TTL of answers without one from an upstream, like hosts pins and records of old cache files")
+	flag.DurationVar(&ttlFloor, "ttl-floor", time.Second, "lowest TTL of answers from the cache, so that clients still cache records about to expire")
+	flag.BoolVar(&dns64, "dns64", false, "synthesize AAAA records from A records for names without any (RFC 6147)")
+	flag.StringVar(&dns64Prefix, "dns64-prefix", "64:ff9b::/96", "NAT64 prefix the addresses synthesized by -dns64 are made in")
+	flag.DurationVar(&queryTimeout, "timeout", 0, "deadline for answering a query, upstream queries still running then are abandoned with SERVFAIL, 0 for none")
+	flag.DurationVar(&queryBudget, "query-budget", 0, "time after which queries needing several resolutions, like DNS64 ones, are answered with the results gathered so far, 0 for none")
+	flag.BoolVar(&noPrivateAnswers, "no-private-answers", false, "drop private, loopback, link-local and bogon addresses from answers, protecting against DNS rebinding")
+	flag.StringVar(&privateAllowPath, "private-answers-allow", "", "The file path to domains exempt from -no-private-answers, matching their subdomains too")
+	flag.StringVar(&allowlistPath, "allowlist", "", "The file path to a list of domains never blocked, overriding -blocklist; both are reloaded on SIGHUP")
+	flag.DurationVar(&coalesceWindow, "coalesce-window", 0, "how long the answer of an upstream query is reused by identical queries after it completed, on top of those arriving while it is in flight")
+	flag.StringVar(&resolvConf, "resolv-conf", "", "The file path to a resolv.conf whose nameservers are used instead of -upstreams, reloaded on SIGHUP")
+	flag.StringVar(&adminAddr, "admin-addr", "", "address of the HTTP admin API, listing the cache at /cache and streaming it out of /cache/export into /cache/import of another instance, and getting or setting the log level at /log-level, disabled when empty")
+	flag.DurationVar(&perUpstreamTimeout, "per-upstream-timeout", 2*time.Second, "how long a single upstream may take to answer before the next one is tried, within -timeout")
+	flag.StringVar(&regexRulesPath, "regex-rules", "", "The file path to \"pattern ip-or-name\" lines answering the names a regular expression matches with that address or a CNAME to that name, the first match winning over upstreams but not -hosts; reloaded on SIGHUP")
+	flag.StringVar(&responsePolicyPath, "response-policy", "", "The file path to a response policy zone (RPZ) with QNAME triggers, reloaded on SIGHUP")
+	flag.BoolVar(&logUpstreams, "log-upstreams", false, "log the upstream, latency and outcome of every upstream query as a JSON line")
+	flag.BoolVar(&clientShuffle, "client-shuffle", false, "order the addresses of answers differently for every client, but always the same for a given client")
+	flag.BoolVar(&compress, "compress", true, "compress names in answers, which keeps answers with many names small enough to avoid truncation; disable for clients that mishandle compression")
+	flag.StringVar(&queryLogPath, "query-log", "", "The file path queries are logged to, one \"time client name type rcode answers latency\" line each")
+	flag.IntVar(&queryLogMaxSize, "query-log-max-size", 100, "size in megabytes beyond which the -query-log is rotated")
+	flag.IntVar(&queryLogMaxFiles, "query-log-max-files", 5, "number of rotated -query-log files kept")
+	flag.BoolVar(&mdns, "mdns", false, "resolve names under -mdns-suffix with multicast DNS instead of the upstreams")
+	flag.StringVar(&mdnsSuffix, "mdns-suffix", "local", "domain resolved with multicast DNS when -mdns is set")
+	flag.StringVar(&metricsAddr, "metrics-addr", "", "address of the HTTP server exporting metrics at /metrics, disabled when empty")
+	flag.IntVar(&domainStatsSize, "domain-stats-size", 100, "number of busiest domains whose cache hits and misses are exported")
+	flag.DurationVar(&domainStatsDecay, "domain-stats-decay", 10*time.Minute, "interval at which the per-domain counts are halved")
 	flag.Parse()
 
+	err := applyEnv(flag.CommandLine)
+	if err != nil {
+		log.Fatalf("Invalid environment variable %s", err)
+	}
+	level, err := initialLogLevel(logLevelFlag)
+	if err != nil {
+		log.Fatalf("Invalid -log-level: %s", err)
+	}
+	logLevel.Store(level)
+	records = newRecordCache(cacheShards, cacheSize)
+	records.compressed = compressCache
+	var listenAddrs []string
+	for _, a := range strings.Split(addr, ",") {
+		if a = strings.TrimSpace(a); a != "" {
+			listenAddrs = append(listenAddrs, a)
+		}
+	}
+	if len(listenAddrs) == 0 {
+		log.Fatal("No -addr given")
+	}
+	if noCache {
+		cachePath = ""
+		cacheBackend = "file"
+	}
+	pacSrc, err := newRuleSource(pacPath, true)
+	if err != nil {
+		log.Fatalf("Invalid -pac: %s", err)
+	}
+	blocklistSrc, err := newRuleSource(blocklistPath, false)
+	if err != nil {
+		log.Fatalf("Invalid -blocklist: %s", err)
+	}
+	allowlistSrc, err := newRuleSource(allowlistPath, false)
+	if err != nil {
+		log.Fatalf("Invalid -allowlist: %s", err)
+	}
+	if check {
+		// validate without side effects: nothing gets created on disk
+		if warmupPath != "-" {
+			if err := checkReadable(warmupPath); err != nil {
+				log.Fatalf("Invalid -warmup file: %s", err)
+			}
+		}
+		if src, ok := pacSrc.(*fileSource); ok {
+			files, err := ruleFiles(src.paths)
+			if err != nil {
+				log.Fatalf("Invalid -pac directory: %s", err)
+			}
+			for _, path := range files {
+				if err := checkReadable(path); err != nil {
+					log.Fatalf("Invalid -pac file: %s", err)
+				}
+			}
+		}
+		for _, a := range listenAddrs {
+			if _, err := net.ResolveUDPAddr("udp", a); err != nil {
+				log.Fatalf("Invalid -addr: %s", err)
+			}
+		}
+		if _, err := os.Stat(cachePath); os.IsNotExist(err) {
+			cachePath = ""
+		}
+	}
+	if err := checkNotDir("cache", cachePath); err != nil {
+		log.Fatal(err)
+	}
 	// Load existing records from cache
-	loadCache(cachePath)
-	handler := &dnsHandler{cachePath: cachePath, pacUpstreams: []string{"8.8.8.8:53", "8.8.4.4:53", "1.1.1.1:53", "114.114.114.114:53"}}
-	handler.nonPacUpStreams = strings.Split(upStreams, ",")
+	if cacheFormat != "text" && cacheFormat != "binary" {
+		log.Fatalf("Unknown -cache-format: %s", cacheFormat)
+	}
+	switch cacheBackend {
+	case "file":
+		loadCache(cachePath)
+	case "bolt":
+		if check {
+			// opening the database would create its bucket, only let
+			// -check see that the file is readable
+			if err := checkReadable(cachePath); err != nil {
+				log.Fatalf("Invalid -cache: %s", err)
+			}
+			break
+		}
+		if cachePath == "" {
+			log.Fatal("-cache-backend bolt requires -cache")
+		}
+		disk, err = openBoltStore(cachePath)
+		if err != nil {
+			log.Fatal("Failed to open cache database: ", err)
+		}
+		defer disk.close()
+	default:
+		log.Fatalf("Unknown cache backend: %s", cacheBackend)
+	}
+	handler := &dnsHandler{cachePath: cachePath, use0x20: use0x20, dohParallel: dohParallel}
+	upstreamSrc := upstreamSources{
+		upstreams:    upStreams,
+		pacUpstreams: pacUpstreams,
+		file:         upstreamsFile,
+		resolvConf:   resolvConf,
+		listeners:    listenerUpstreamsPath,
+	}
+	conf, err := loadUpstreamConfig(upstreamSrc)
+	if err != nil {
+		log.Fatalf("Invalid upstreams: %s", err)
+	}
+	handler.upstreams.Store(conf)
+	if isDebug() && len(conf.byListener) > 0 {
+		log.Println("[DEBUG] listener upstreams:\n", conf.byListener)
+	}
+	handler.refuseAny = refuseAny
+	if padding < 0 || padding > 65535 {
+		log.Fatalf("Invalid -padding: %d", padding)
+	}
+	handler.padding = padding
+	handler.maxCacheAge = maxCacheAge
+	handler.servfailTTL = servfailTTL
+	handler.ttlFloor = ttlFloor
+	handler.defaultTTL = uint32(defaultTTL / time.Second)
+	handler.queryTimeout = queryTimeout
+	handler.queryBudget = queryBudget
+	handler.perUpstreamTimeout = perUpstreamTimeout
+	handler.logUpstreams = logUpstreams
+	handler.clientShuffle = clientShuffle
+	handler.compress = compress
+	handler.viaHints = viaHints
+	handler.srvTargets = srvTargets
+	handler.serveStaleOnError = serveStaleOnError
+	if clientQuotaLimit > 0 {
+		handler.quota = newClientQuota(clientQuotaLimit)
+	}
+	if injectDelay > 0 {
+		log.Printf("Delaying every answer by %s (-inject-delay), do not use in production", injectDelay)
+		handler.injectDelay = injectDelay
+	}
+	if handler.tlsServerNames, err = parseTLSServerNames(tlsServerNames); err != nil {
+		log.Fatalf("Invalid -upstream-tls-servername: %s", err)
+	}
+	if handler.tlsPins, err = parseTLSPins(tlsPins); err != nil {
+		log.Fatalf("Invalid -upstream-tls-pin: %s", err)
+	}
+	if cacheFlushInterval > 0 && disk == nil && cachePath != "" && !check && !once {
+		handler.cacheFlushInterval = cacheFlushInterval
+		go flushCacheEvery(cachePath, cacheFlushInterval)
+	}
+	if mdns {
+		handler.mdnsSuffix = dns.Fqdn(strings.ToLower(mdnsSuffix))
+	}
+	if proxyURL != "" {
+		if err := handler.setProxy(proxyURL); err != nil {
+			log.Fatalf("Invalid -proxy: %s", err)
+		}
+	}
+	handler.upstreamStats = newUpstreamStats()
+	handler.flights = newCoalescer(coalesceWindow)
+	if dns64 {
+		handler.dns64Prefix, err = parseDNS64Prefix(dns64Prefix)
+		if err != nil {
+			log.Fatalf("Invalid -dns64-prefix: %s", err)
+		}
+	}
+	switch pacDefault {
+	case "upstream", "doh", "block":
+		handler.pacDefault = pacDefault
+	default:
+		log.Fatalf("Unknown -pac-default: %s", pacDefault)
+	}
+	switch upstreamMode {
+	case "order", "hash", "fastest", "failover-sticky":
+		handler.upstreamMode = upstreamMode
+	default:
+		log.Fatalf("Unknown -upstream-mode: %s", upstreamMode)
+	}
+	switch adMode {
+	case "clear", "upstream":
+		handler.adMode = adMode
+	default:
+		log.Fatalf("Unknown -ad-bit: %s", adMode)
+	}
+	switch pacMode {
+	case "doh-listed", "direct-listed":
+		handler.pacMode = pacMode
+	default:
+		log.Fatalf("Unknown -pac-mode: %s", pacMode)
+	}
+	handler.minimalAnswers = minimalAnswers
+	handler.noCache = noCache
+	handler.dohRetries = dohRetries
+	handler.dohRetryDelay = dohRetryDelay
+	handler.allowedClients, err = parseCIDRs(allowClients)
+	if err != nil {
+		log.Fatalf("Invalid -allow network: %s", err)
+	}
+	if updateUpstream != "" {
+		if _, _, err := net.SplitHostPort(updateUpstream); err != nil {
+			log.Fatalf("Invalid -update-upstream: %s", err)
+		}
+		handler.updateUpstream = updateUpstream
+		handler.updateClients, err = parseCIDRs(updateClients)
+		if err != nil {
+			log.Fatalf("Invalid -update-allow network: %s", err)
+		}
+		if len(handler.updateClients) == 0 {
+			log.Println("No -update-allow networks, every update is refused")
+		}
+	}
+	handler.nsid = nsid
+	handler.ednsPassthrough, err = parseOptionCodes(ednsPassthrough)
+	if err != nil {
+		log.Fatalf("Invalid -edns-passthrough option code: %s", err)
+	}
 
-	handler.parsePacFile(pacPath)
+	handler.parsePacFile(pacSrc)
+	if pacURL != "" {
+		rules, err := handler.fetchPac(pacURL)
+		if err != nil && check {
+			log.Fatalf("Failed to fetch pac from %s: %s", pacURL, err)
+		} else if err != nil {
+			log.Printf("Failed to fetch pac from %s, keeping the -pac rules: %s", pacURL, err)
+		} else {
+			handler.setPacRules(rules)
+		}
+		if !check && pacRefresh > 0 {
+			go handler.refreshPac(pacURL, pacRefresh)
+		}
+	}
+	handler.parseTTLOverrides(ttlOverridesPath)
+	if noPrivateAnswers {
+		allow := loadHostsFile("private answers allowlist", privateAllowPath)
+		handler.Use(newPrivateAnswerFilter(func(name string) bool {
+			// pinned names answer what the hosts file says
+			_, pinned := handler.hosts.lookup(name)
+			return pinned || allow.matches(name)
+		}))
+	}
+	if remapPath != "" {
+		remap, err := newIPRemapper(remapPath)
+		if err != nil {
+			log.Fatal("Failed to read remap file: ", err)
+		}
+		handler.Use(remap)
+	}
+	handler.hosts = loadHostsFile("hosts", hostsPath)
+	if signZone != "" {
+		handler.signer, err = loadZoneSigner(signZone, signKey)
+		if err != nil {
+			log.Fatal("Failed to load -sign-key: ", err)
+		}
+	}
+	handler.setLists(loadRuleTable("blocklist", blocklistSrc), loadRuleTable("allowlist", allowlistSrc))
+	if !check && rulesRefresh > 0 {
+		refreshed := pacSrc
+		if pacURL != "" {
+			// rules of -pac-url replace the -pac ones
+			refreshed = nil
+		}
+		go handler.refreshRules(refreshed, blocklistSrc, allowlistSrc, rulesRefresh)
+	}
+	if responsePolicyPath != "" {
+		handler.policy, err = loadResponsePolicy(responsePolicyPath)
+		if err != nil {
+			log.Fatal("Failed to read response policy zone: ", err)
+		}
+		log.Printf("Loaded %d response policies", len(handler.policy.exact)+len(handler.policy.wildcard))
+	}
+	if regexRulesPath != "" {
+		handler.regexes, err = loadRegexRules(regexRulesPath)
+		if err != nil {
+			log.Fatal("Failed to read regex rules: ", err)
+		}
+		log.Printf("Loaded %d regex rules", len(handler.regexes))
+	}
+	if check {
+		handler.printSummary(os.Stdout, addr)
+		return
+	}
+	if pipe {
+		if err := handler.servePipe(os.Stdin, os.Stdout); err != nil {
+			log.Fatal("Failed to answer the query from stdin: ", err)
+		}
+		return
+	}
+	if once {
+		// build a cache to ship, e.g. idns -once -cache warm.cache < domains
+		if warmupPath == "" {
+			warmupPath = "-"
+		}
+		domains, err := readDomainList(warmupPath)
+		if err != nil {
+			log.Fatal("Failed to read warm-up domains: ", err)
+		}
+		handler.warmUp(domains, warmupWorkers)
+		if disk == nil && cachePath != "" {
+			saveCache(cachePath)
+		}
+		return
+	}
+	if metricsAddr != "" {
+		handler.domainStats = newDomainStats(domainStatsSize)
+		handler.ttlStats = newTTLHistogram()
+		handler.transportStats = newTransportStats()
+		if domainStatsDecay > 0 {
+			go handler.domainStats.decayEvery(domainStatsDecay)
+		}
+		go handler.serveMetrics(metricsAddr)
+	}
+	var dohServer *http.Server
+	if dohAddr != "" {
+		if (dohCert == "") != (dohKey == "") {
+			log.Fatal("-doh-cert and -doh-key go together")
+		}
+		dohServer = handler.serveDoH(dohAddr, dohCert, dohKey)
+	}
+	if restAddr != "" {
+		go handler.serveREST(restAddr)
+	}
+	if adminAddr != "" {
+		go handler.serveAdmin(adminAddr)
+	}
+	if queryLogPath != "" {
+		handler.queryLog, err = openQueryLog(queryLogPath, int64(queryLogMaxSize)<<20, queryLogMaxFiles)
+		if err != nil {
+			log.Fatal("Failed to open query log: ", err)
+		}
+	}
+	if dropAAAA {
+		go handler.probeIPv6(ipv6ProbeTarget, ipv6ProbeInterval)
+	}
+	if warmupPath != "" {
+		domains, err := readDomainList(warmupPath)
+		if err != nil {
+			log.Fatal("Failed to read warm-up file: ", err)
+		}
+		handler.warmUp(domains, warmupWorkers)
+	}
 	if isDebug() {
-		fmt.Println(DEBUG_PREFIX, handler.nonPacUpStreams)
-	}
-	server := &dns.Server{
-		Addr:      addr,
-		Net:       "udp",
-		Handler:   handler,
-		UDPSize:   65535,
-		ReusePort: true,
-	}
-	log.Printf("Starting at %s\n", addr)
-	err := server.ListenAndServe()
-	defer server.Shutdown()
-	if err != nil {
-		log.Fatalf("Failed to start server: %s\n ", err.Error())
+		fmt.Println(DEBUG_PREFIX, handler.defaultUpstreams())
+	}
+	var servers []*dns.Server
+	for _, a := range listenAddrs {
+		s := &dns.Server{
+			Addr:      a,
+			Net:       "udp",
+			Handler:   handler,
+			UDPSize:   65535,
+			ReusePort: true,
+		}
+		if udpRcvbuf > 0 || udpSndbuf > 0 {
+			if s.PacketConn, err = listenUDP(a, udpRcvbuf, udpSndbuf); err != nil {
+				log.Fatalf("Failed to start server: udp %s: %s", a, err)
+			}
+		}
+		servers = append(servers, s)
+		if serveTCP {
+			// clients retry truncated answers over TCP
+			servers = append(servers, &dns.Server{Addr: a, Net: "tcp", Handler: handler})
+		}
+	}
+	if updateUpstream != "" {
+		for _, s := range servers {
+			s.MsgAcceptFunc = acceptUpdates
+		}
+	}
+	if pidfile != "" {
+		if err := os.WriteFile(pidfile, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644); err != nil {
+			log.Fatal("Failed to write -pidfile: ", err)
+		}
+		defer os.Remove(pidfile)
+	}
+	cycleLogLevelOnSignal()
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if blocklistSrc != nil || allowlistSrc != nil {
+				handler.reloadLists(blocklistSrc, allowlistSrc)
+			}
+			handler.reloadUpstreams(upstreamSrc)
+			if pacSrc != nil && pacURL == "" {
+				// rules of -pac-url replace the files' and refresh on their own
+				handler.reloadPac(pacSrc)
+			}
+			if responsePolicyPath != "" {
+				handler.reloadResponsePolicy(responsePolicyPath)
+			}
+			if regexRulesPath != "" {
+				handler.reloadRegexRules(regexRulesPath)
+			}
+		}
+	}()
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	drained := make(chan struct{})
+	go func() {
+		sig := <-stop
+		log.Printf("Received %s, shutting down", sig)
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		handler.drain(ctx, servers, dohServer)
+		close(drained)
+	}()
+	errs := make(chan error, len(servers))
+	for _, s := range servers {
+		go func(s *dns.Server) {
+			serve := s.ListenAndServe
+			if s.PacketConn != nil {
+				serve = s.ActivateAndServe
+			}
+			if err := serve(); err != nil {
+				errs <- fmt.Errorf("%s %s: %w", s.Net, s.Addr, err)
+				return
+			}
+			errs <- nil
+		}(s)
+	}
+	handler.logConfig(flag.CommandLine)
+	log.Printf("Starting at %s\n", strings.Join(listenAddrs, ", "))
+	for running := len(servers); running > 0; {
+		select {
+		case err := <-errs:
+			if err != nil {
+				os.Remove(pidfile)
+				log.Fatalf("Failed to start server: %s\n ", err.Error())
+			}
+			running--
+		case <-drained:
+			// servers still answering queries past -shutdown-timeout
+			// are not waited for
+			running = 0
+		}
+	}
+	<-drained
+	if handler.cacheFlushInterval > 0 {
+		// the servers are shut down, keep what changed since the last flush
+		flushCache(cachePath)
 	}
 
 }
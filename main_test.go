@@ -0,0 +1,237 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// startUpstream serves handler over UDP on a free local port and returns
+// its address.
+func startUpstream(t testing.TB, handler dns.HandlerFunc) string {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan struct{})
+	s := &dns.Server{PacketConn: pc, Handler: handler, NotifyStartedFunc: func() { close(started) }}
+	go s.ActivateAndServe()
+	<-started
+	t.Cleanup(func() { s.Shutdown() })
+	return pc.LocalAddr().String()
+}
+
+// TestMain sets up the cache shared by the tests, which query names of
+// their own.
+func TestMain(m *testing.M) {
+	records = newRecordCache(1, 0)
+	os.Exit(m.Run())
+}
+
+var testNames atomic.Int32
+
+// testName returns a name under example.com no other test run queries.
+func testName(label string) string {
+	return fmt.Sprintf("%s%d.example.com.", label, testNames.Add(1))
+}
+
+var (
+	testHandlersMu sync.Mutex
+	testHandlers   []*dnsHandler
+)
+
+// newTestHandler returns a handler resolving through the plain upstream at
+// addr.
+func newTestHandler(addr string) *dnsHandler {
+	h := &dnsHandler{perUpstreamTimeout: time.Second, defaultTTL: 3600}
+	h.upstreams.Store(&upstreamConfig{plain: &upstreamList{addrs: []string{addr}}})
+	testHandlersMu.Lock()
+	testHandlers = append(testHandlers, h)
+	testHandlersMu.Unlock()
+	return h
+}
+
+// waitForCacheWrites waits until every test handler wrote the answers it
+// caches in the background.
+func waitForCacheWrites() {
+	testHandlersMu.Lock()
+	defer testHandlersMu.Unlock()
+	for _, h := range testHandlers {
+		h.inflight.Wait()
+	}
+}
+
+func query(h *dnsHandler, name string, qtype uint16) *dns.Msg {
+	r := new(dns.Msg)
+	r.SetQuestion(name, qtype)
+	return serve(h, r)
+}
+
+// serve answers r with h as a TCP client would be answered, so that nothing
+// is truncated.
+func serve(h *dnsHandler, r *dns.Msg) *dns.Msg {
+	w := &dohWriter{remote: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5353}}
+	h.ServeDNS(w, r)
+	return w.msg
+}
+
+func TestServeDNSQuestionCount(t *testing.T) {
+	questions := map[string][]dns.Question{
+		"none": nil,
+		"two": {
+			{Name: "example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET},
+			{Name: "example.org.", Qtype: dns.TypeA, Qclass: dns.ClassINET},
+		},
+	}
+	for name, qs := range questions {
+		r := new(dns.Msg)
+		r.Id = dns.Id()
+		r.RecursionDesired = true
+		r.Question = qs
+		m := serve(&dnsHandler{}, r)
+		if m == nil {
+			t.Fatalf("%s: no answer", name)
+		}
+		if m.Rcode != dns.RcodeFormatError {
+			t.Errorf("%s: rcode %s, want FORMERR", name, dns.RcodeToString[m.Rcode])
+		}
+		if len(m.Answer) != 0 {
+			t.Errorf("%s: answered %v", name, m.Answer)
+		}
+	}
+}
+
+func TestForwardsCAA(t *testing.T) {
+	addr := startUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		if r.Question[0].Qtype == dns.TypeCAA {
+			for _, s := range []string{
+				`example.com. 300 IN CAA 0 issue "letsencrypt.org"`,
+				`example.com. 300 IN CAA 128 iodef "mailto:security@example.com"`,
+			} {
+				rr, _ := dns.NewRR(s)
+				m.Answer = append(m.Answer, rr)
+			}
+		}
+		w.WriteMsg(m)
+	})
+	m := query(newTestHandler(addr), "example.com.", dns.TypeCAA)
+	if m.Rcode != dns.RcodeSuccess {
+		t.Fatalf("rcode %s", dns.RcodeToString[m.Rcode])
+	}
+	caa := onlyType(m.Answer, dns.TypeCAA)
+	if len(caa) != 2 {
+		t.Fatalf("answered %v, want the 2 CAA records", m.Answer)
+	}
+	if r := caa[0].(*dns.CAA); r.Flag != 0 || r.Tag != "issue" || r.Value != "letsencrypt.org" {
+		t.Errorf("first record %v", r)
+	}
+	if r := caa[1].(*dns.CAA); r.Flag != 128 || r.Tag != "iodef" || r.Value != "mailto:security@example.com" {
+		t.Errorf("second record %v", r)
+	}
+}
+
+func TestNewUpstreamAnswerCanonicalizes(t *testing.T) {
+	var answer []dns.RR
+	for _, s := range []string{
+		"WWW.Example.COM. 300 IN CNAME Edge.CDN.example.NET.",
+		"edge.cdn.EXAMPLE.net 60 IN A 192.0.2.1",
+	} {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		answer = append(answer, rr)
+	}
+	ua := newUpstreamAnswer(answer)
+	if name := ua.rrs[0].Header().Name; name != "www.example.com." {
+		t.Errorf("CNAME owner %q", name)
+	}
+	if target := ua.rrs[0].(*dns.CNAME).Target; target != "edge.cdn.example.net." {
+		t.Errorf("CNAME target %q", target)
+	}
+	if name := ua.rrs[1].Header().Name; name != "edge.cdn.example.net." {
+		t.Errorf("A owner %q", name)
+	}
+	if ua.ttl != 60 {
+		t.Errorf("TTL %d, want the lowest, 60", ua.ttl)
+	}
+}
+
+func TestMixedCaseUpstreamCachesOnce(t *testing.T) {
+	var queries atomic.Int32
+	addr := startUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		queries.Add(1)
+		m := new(dns.Msg)
+		m.SetReply(r)
+		rr, _ := dns.NewRR(randomizeCase(r.Question[0].Name) + " 300 IN A 192.0.2.1")
+		m.Answer = append(m.Answer, rr)
+		w.WriteMsg(m)
+	})
+	h := newTestHandler(addr)
+	base := testName("mixed")
+	for i, name := range []string{"M" + base[1:], base, strings.ToUpper(base)} {
+		m := query(h, name, dns.TypeA)
+		if len(m.Answer) != 1 {
+			t.Fatalf("%s: answered %v", name, m.Answer)
+		}
+		if owner := m.Answer[0].Header().Name; owner != name {
+			t.Errorf("%s: answered for %q, want the spelling of the question", name, owner)
+		}
+		if i == 0 {
+			// the answer is cached in the background
+			for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+				if _, ok := records.get(cacheKey{base, dns.TypeA}); ok {
+					break
+				}
+			}
+		}
+	}
+	entries := 0
+	records.each(func(key cacheKey, _ record) {
+		if strings.EqualFold(key.name, base) {
+			entries++
+		}
+	})
+	if entries != 1 {
+		t.Errorf("%d cache entries, want 1", entries)
+	}
+	if _, ok := records.get(cacheKey{base, dns.TypeA}); !ok {
+		t.Error("not cached under the lowercase name")
+	}
+	if n := queries.Load(); n != 1 {
+		t.Errorf("%d upstream queries, want 1", n)
+	}
+}
+
+func TestNegativeAnswerAfterCNAMEKeepsSOA(t *testing.T) {
+	name := testName("alias")
+	addr := startUpstream(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.Rcode = dns.RcodeNameError
+		cname, _ := dns.NewRR(r.Question[0].Name + " 300 IN CNAME gone.example.net.")
+		soa, _ := dns.NewRR("example.net. 300 IN SOA ns.example.net. hostmaster.example.net. 1 7200 3600 1209600 300")
+		m.Answer = append(m.Answer, cname)
+		m.Ns = append(m.Ns, soa)
+		w.WriteMsg(m)
+	})
+	m := query(newTestHandler(addr), name, dns.TypeA)
+	if m.Rcode != dns.RcodeNameError {
+		t.Errorf("rcode %s, want NXDOMAIN", dns.RcodeToString[m.Rcode])
+	}
+	if len(onlyType(m.Answer, dns.TypeCNAME)) != 1 {
+		t.Errorf("answered %v, want the CNAME", m.Answer)
+	}
+	if soa := onlyType(m.Ns, dns.TypeSOA); len(soa) != 1 || soa[0].Header().Name != "example.net." {
+		t.Errorf("authority %v, want the SOA of the target", m.Ns)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	sourceMDNS = "mdns"
+	// mdnsTimeout is how long responders get to answer, and mdnsTTL caps
+	// how long their answers are cached, local devices come and go.
+	mdnsTimeout = time.Second
+	mdnsTTL     = 10
+)
+
+var mdnsGroup = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+// fetchMDNS resolves name with a one-shot multicast DNS query (RFC 6762
+// 5.1), sent from an ephemeral port so that responders answer it directly.
+// Without any answer the name is answered with NODATA: a device may well
+// exist and just be switched off.
+func (h *dnsHandler) fetchMDNS(ctx context.Context, name string, qtype uint16) upstreamAnswer {
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return upstreamAnswer{err: err}
+	}
+	defer conn.Close()
+	deadline := time.Now().Add(mdnsTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetDeadline(deadline)
+
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(name), qtype)
+	m.RecursionDesired = false
+	query, err := m.Pack()
+	if err != nil {
+		return upstreamAnswer{err: err}
+	}
+	if _, err := conn.WriteToUDP(query, mdnsGroup); err != nil {
+		return upstreamAnswer{err: err}
+	}
+	buf := make([]byte, dns.MaxMsgSize)
+	for {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			// timed out without an answer
+			return upstreamAnswer{source: sourceMDNS}
+		}
+		r := new(dns.Msg)
+		if r.Unpack(buf[:n]) != nil || !r.Response || (r.Id != m.Id && r.Id != 0) {
+			continue
+		}
+		var answer []dns.RR
+		for _, rr := range r.Answer {
+			if strings.EqualFold(rr.Header().Name, name) && rr.Header().Rrtype == qtype {
+				// the top bit of the class is the cache-flush flag
+				rr.Header().Class &^= 1 << 15
+				answer = append(answer, rr)
+			}
+		}
+		if len(answer) == 0 {
+			continue
+		}
+		ua := newUpstreamAnswer(answer)
+		if ua.ttl > mdnsTTL {
+			ua.ttl = mdnsTTL
+		}
+		ua.source = sourceMDNS
+		return ua
+	}
+}
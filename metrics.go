@@ -0,0 +1,397 @@
+package main
+
+import (
+	"container/heap"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+type domainCounts struct {
+	hits, misses uint64
+}
+
+func (c *domainCounts) total() uint64 { return c.hits + c.misses }
+
+// domainEntry is a tracked domain. A domain taking the place of an evicted
+// one inherits its weight, as in the space-saving algorithm: it ranks as if
+// it had been counted all along, so newcomers do not evict each other while
+// domains queried often build up counts. Only its own hits and misses are
+// exported.
+type domainEntry struct {
+	name string
+	domainCounts
+	inherited uint64
+	index     int // in the heap
+}
+
+func (e *domainEntry) weight() uint64 { return e.total() + e.inherited }
+
+// domainHeap orders the tracked domains lightest first.
+type domainHeap []*domainEntry
+
+func (h domainHeap) Len() int           { return len(h) }
+func (h domainHeap) Less(i, j int) bool { return h[i].weight() < h[j].weight() }
+func (h domainHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index, h[j].index = i, j
+}
+func (h *domainHeap) Push(x any) {
+	e := x.(*domainEntry)
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+func (h *domainHeap) Pop() any {
+	old := *h
+	e := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return e
+}
+
+// domainStats counts cache hits and misses per domain. At most size domains
+// are tracked: a new domain replaces the lightest one, so only the busiest
+// domains survive and the cardinality of the exported metrics stays bounded.
+type domainStats struct {
+	mu     sync.Mutex
+	size   int
+	counts map[string]*domainEntry
+	heap   domainHeap
+}
+
+func newDomainStats(size int) *domainStats {
+	return &domainStats{size: size, counts: make(map[string]*domainEntry, size)}
+}
+
+func (s *domainStats) record(name string, hit bool) {
+	if s == nil || s.size <= 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e := s.counts[name]
+	switch {
+	case e != nil:
+	case len(s.counts) >= s.size:
+		e = s.heap[0]
+		delete(s.counts, e.name)
+		*e = domainEntry{name: name, inherited: e.weight(), index: e.index}
+		s.counts[name] = e
+	default:
+		e = &domainEntry{name: name}
+		s.counts[name] = e
+		heap.Push(&s.heap, e)
+	}
+	if hit {
+		e.hits++
+	} else {
+		e.misses++
+	}
+	heap.Fix(&s.heap, e.index)
+}
+
+// decay halves every count and forgets domains that drop to zero, so the
+// table follows the current traffic rather than the all-time totals.
+func (s *domainStats) decay() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.heap = s.heap[:0]
+	for name, e := range s.counts {
+		e.hits /= 2
+		e.misses /= 2
+		e.inherited /= 2
+		if e.weight() == 0 {
+			delete(s.counts, name)
+			continue
+		}
+		s.heap = append(s.heap, e)
+	}
+	for i, e := range s.heap {
+		e.index = i
+	}
+	heap.Init(&s.heap)
+}
+
+func (s *domainStats) decayEvery(interval time.Duration) {
+	for range time.Tick(interval) {
+		s.decay()
+	}
+}
+
+type domainCount struct {
+	name string
+	domainCounts
+}
+
+// top returns the tracked domains, busiest first.
+func (s *domainStats) top() []domainCount {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	list := make([]domainCount, 0, len(s.counts))
+	for name, e := range s.counts {
+		list = append(list, domainCount{name, e.domainCounts})
+	}
+	s.mu.Unlock()
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].total() != list[j].total() {
+			return list[i].total() > list[j].total()
+		}
+		return list[i].name < list[j].name
+	})
+	return list
+}
+
+// upstreamStats accumulates the latencies of the queries sent to each
+// upstream. There are only as many as configured, so nothing is evicted.
+type upstreamStats struct {
+	mu    sync.Mutex
+	stats map[string]*upstreamStat
+}
+
+type upstreamStat struct {
+	queries, errors uint64
+	rtt             time.Duration // total of the successful queries
+	avg             time.Duration // moving average of recent queries
+}
+
+// rttWeight is the weight of the latest query in the moving average, and
+// failurePenalty the round trip time counted for a failed query.
+const (
+	rttWeight      = 0.2
+	failurePenalty = 2 * time.Second
+)
+
+func newUpstreamStats() *upstreamStats {
+	return &upstreamStats{stats: make(map[string]*upstreamStat)}
+}
+
+func (s *upstreamStats) observe(upstream string, rtt time.Duration, err error) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := s.stats[upstream]
+	if st == nil {
+		st = &upstreamStat{}
+		s.stats[upstream] = st
+	}
+	st.queries++
+	sample := rtt
+	if err != nil {
+		st.errors++
+		sample = failurePenalty
+	} else {
+		st.rtt += rtt
+	}
+	if st.queries == 1 {
+		st.avg = sample
+	} else {
+		st.avg += time.Duration(rttWeight * float64(sample-st.avg))
+	}
+}
+
+// average returns the moving average round trip time of upstream, zero if
+// it was never queried.
+func (s *upstreamStats) average(upstream string) time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if st := s.stats[upstream]; st != nil {
+		return st.avg
+	}
+	return 0
+}
+
+func (s *upstreamStats) write(w io.Writer) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	upstreams := make([]string, 0, len(s.stats))
+	for us := range s.stats {
+		upstreams = append(upstreams, us)
+	}
+	sort.Strings(upstreams)
+	fmt.Fprintln(w, "# HELP idns_upstream_queries_total Queries sent to each upstream.")
+	fmt.Fprintln(w, "# TYPE idns_upstream_queries_total counter")
+	for _, us := range upstreams {
+		fmt.Fprintf(w, "idns_upstream_queries_total{upstream=%q} %d\n", us, s.stats[us].queries)
+	}
+	fmt.Fprintln(w, "# HELP idns_upstream_errors_total Queries to each upstream that got no answer.")
+	fmt.Fprintln(w, "# TYPE idns_upstream_errors_total counter")
+	for _, us := range upstreams {
+		fmt.Fprintf(w, "idns_upstream_errors_total{upstream=%q} %d\n", us, s.stats[us].errors)
+	}
+	fmt.Fprintln(w, "# HELP idns_upstream_rtt_seconds_total Total round trip time of the answered queries to each upstream.")
+	fmt.Fprintln(w, "# TYPE idns_upstream_rtt_seconds_total counter")
+	for _, us := range upstreams {
+		fmt.Fprintf(w, "idns_upstream_rtt_seconds_total{upstream=%q} %g\n", us, s.stats[us].rtt.Seconds())
+	}
+}
+
+// transports are the ways queries arrive, as labeled in the metrics.
+var transports = []string{"udp", "tcp", "doh"}
+
+// transportStats counts the queries arriving over each inbound transport
+// and the time taken answering them. The set of transports is fixed, so the
+// counters are updated without a lock.
+type transportStats map[string]*transportStat
+
+type transportStat struct {
+	queries atomic.Uint64
+	nanos   atomic.Int64
+}
+
+func newTransportStats() transportStats {
+	s := make(transportStats, len(transports))
+	for _, t := range transports {
+		s[t] = &transportStat{}
+	}
+	return s
+}
+
+// transportOf returns the transport the query answered through w came over.
+func transportOf(w dns.ResponseWriter) string {
+	if _, ok := w.(*dohWriter); ok {
+		return "doh"
+	}
+	if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+		return "udp"
+	}
+	return "tcp"
+}
+
+func (s transportStats) observe(transport string, elapsed time.Duration) {
+	if st := s[transport]; st != nil {
+		st.queries.Add(1)
+		st.nanos.Add(int64(elapsed))
+	}
+}
+
+func (s transportStats) write(w io.Writer) {
+	if s == nil {
+		return
+	}
+	fmt.Fprintln(w, "# HELP idns_queries_total Queries received over each inbound transport.")
+	fmt.Fprintln(w, "# TYPE idns_queries_total counter")
+	for _, t := range transports {
+		fmt.Fprintf(w, "idns_queries_total{transport=%q} %d\n", t, s[t].queries.Load())
+	}
+	fmt.Fprintln(w, "# HELP idns_query_duration_seconds_total Total time taken answering the queries of each inbound transport.")
+	fmt.Fprintln(w, "# TYPE idns_query_duration_seconds_total counter")
+	for _, t := range transports {
+		fmt.Fprintf(w, "idns_query_duration_seconds_total{transport=%q} %g\n", t, time.Duration(s[t].nanos.Load()).Seconds())
+	}
+}
+
+// ttlBuckets are the upper bounds in seconds of the TTL histogram buckets.
+var ttlBuckets = []uint32{0, 10, 30, 60, 300, 900, 3600, 14400, 86400}
+
+// ttlHistogram counts the TTLs upstreams answer with, per record type.
+type ttlHistogram struct {
+	mu     sync.Mutex
+	counts map[uint16]*ttlCounts
+}
+
+type ttlCounts struct {
+	buckets []uint64 // per bucket of ttlBuckets, the last for larger TTLs
+	sum     uint64
+	count   uint64
+}
+
+func newTTLHistogram() *ttlHistogram {
+	return &ttlHistogram{counts: make(map[uint16]*ttlCounts)}
+}
+
+func (t *ttlHistogram) observe(qtype uint16, ttl uint32) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	c := t.counts[qtype]
+	if c == nil {
+		c = &ttlCounts{buckets: make([]uint64, len(ttlBuckets)+1)}
+		t.counts[qtype] = c
+	}
+	i := sort.Search(len(ttlBuckets), func(i int) bool { return ttl <= ttlBuckets[i] })
+	c.buckets[i]++
+	c.sum += uint64(ttl)
+	c.count++
+}
+
+func (t *ttlHistogram) write(w io.Writer) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	types := make([]string, 0, len(t.counts))
+	byName := make(map[string]*ttlCounts, len(t.counts))
+	for qtype, c := range t.counts {
+		name := dns.TypeToString[qtype]
+		types = append(types, name)
+		byName[name] = c
+	}
+	sort.Strings(types)
+	fmt.Fprintln(w, "# HELP idns_upstream_ttl_seconds TTLs of the answers from the upstreams by record type.")
+	fmt.Fprintln(w, "# TYPE idns_upstream_ttl_seconds histogram")
+	for _, name := range types {
+		c := byName[name]
+		var cumulative uint64
+		for i, le := range ttlBuckets {
+			cumulative += c.buckets[i]
+			fmt.Fprintf(w, "idns_upstream_ttl_seconds_bucket{type=%q,le=\"%d\"} %d\n", name, le, cumulative)
+		}
+		fmt.Fprintf(w, "idns_upstream_ttl_seconds_bucket{type=%q,le=\"+Inf\"} %d\n", name, c.count)
+		fmt.Fprintf(w, "idns_upstream_ttl_seconds_sum{type=%q} %d\n", name, c.sum)
+		fmt.Fprintf(w, "idns_upstream_ttl_seconds_count{type=%q} %d\n", name, c.count)
+	}
+}
+
+// writeMetrics writes the metrics in the Prometheus text format.
+func (h *dnsHandler) writeMetrics(w io.Writer) {
+	fmt.Fprintln(w, "# HELP idns_cached_records Number of records held in the memory cache.")
+	fmt.Fprintln(w, "# TYPE idns_cached_records gauge")
+	fmt.Fprintf(w, "idns_cached_records %d\n", records.len())
+	fmt.Fprintln(w, "# HELP idns_cache_evictions_total Records evicted from the memory cache to stay within -cache-size.")
+	fmt.Fprintln(w, "# TYPE idns_cache_evictions_total counter")
+	fmt.Fprintf(w, "idns_cache_evictions_total %d\n", records.evictions.Load())
+	fmt.Fprintln(w, "# HELP idns_coalesced_queries_total Queries answered by sharing the upstream query of an identical one.")
+	fmt.Fprintln(w, "# TYPE idns_coalesced_queries_total counter")
+	fmt.Fprintf(w, "idns_coalesced_queries_total %d\n", h.flights.coalesced.Load())
+	down := 0
+	if h.ipv6Down.Load() {
+		down = 1
+	}
+	fmt.Fprintln(w, "# HELP idns_ipv6_down 1 while the IPv6 probe finds IPv6 unreachable and AAAA queries are answered with NODATA.")
+	fmt.Fprintln(w, "# TYPE idns_ipv6_down gauge")
+	fmt.Fprintf(w, "idns_ipv6_down %d\n", down)
+	fmt.Fprintln(w, "# HELP idns_domain_queries Recent cache hits and misses of the busiest domains, halved periodically.")
+	fmt.Fprintln(w, "# TYPE idns_domain_queries gauge")
+	for _, d := range h.domainStats.top() {
+		fmt.Fprintf(w, "idns_domain_queries{domain=%q,result=\"hit\"} %d\n", d.name, d.hits)
+		fmt.Fprintf(w, "idns_domain_queries{domain=%q,result=\"miss\"} %d\n", d.name, d.misses)
+	}
+	h.transportStats.write(w)
+	h.upstreamStats.write(w)
+	h.ttlStats.write(w)
+}
+
+func (h *dnsHandler) serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		h.writeMetrics(w)
+	})
+	serveHTTP("metrics", addr, mux)
+}
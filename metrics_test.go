@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestDomainStatsKeepHeavyHitters(t *testing.T) {
+	s := newDomainStats(4)
+	// warm makes 2 of every 5 queries, above the 1/4 a domain needs to be
+	// sure to stay, among names never queried again
+	for i := 0; i < 100; i++ {
+		s.record("warm.example.com.", true)
+		s.record("warm.example.com.", false)
+		for j := 0; j < 3; j++ {
+			s.record(fmt.Sprintf("once%d-%d.example.com.", i, j), false)
+		}
+	}
+	top := s.top()
+	if len(top) != 4 {
+		t.Fatalf("tracking %d domains, want 4", len(top))
+	}
+	if top[0].name != "warm.example.com." || top[0].hits != 100 || top[0].misses != 100 {
+		t.Errorf("busiest %+v, want warm.example.com. with its own 100 hits and misses", top[0])
+	}
+	s.decay()
+	if top := s.top(); top[0].name != "warm.example.com." || top[0].hits != 50 {
+		t.Errorf("after decay busiest %+v", top[0])
+	}
+}
+
+func TestMetricsIPv6Down(t *testing.T) {
+	h := &dnsHandler{
+		domainStats:    newDomainStats(1),
+		ttlStats:       newTTLHistogram(),
+		transportStats: newTransportStats(),
+		upstreamStats:  newUpstreamStats(),
+		flights:        newCoalescer(0),
+	}
+	for _, down := range []bool{false, true} {
+		h.ipv6Down.Store(down)
+		var buf bytes.Buffer
+		h.writeMetrics(&buf)
+		want := "idns_ipv6_down 0\n"
+		if down {
+			want = "idns_ipv6_down 1\n"
+		}
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("IPv6 down %t, metrics lack %q", down, want)
+		}
+	}
+}
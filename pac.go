@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// parsePac reads PAC rules, one domain per line.
+func parsePac(r io.Reader) (map[string]bool, error) {
+	rules := make(map[string]bool)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		rules[strings.ToLower(line)+"."] = true
+	}
+	return rules, scanner.Err()
+}
+
+func (h *dnsHandler) setPacRules(rules map[string]bool) {
+	h.pacMu.Lock()
+	h.pacRules = rules
+	h.pacMu.Unlock()
+	if isDebug() {
+		log.Println("[DEBUG] PAC rules:\n", rules)
+	}
+}
+
+func (h *dnsHandler) hasPacRule(name string) bool {
+	h.pacMu.RLock()
+	defer h.pacMu.RUnlock()
+	return h.pacRules[name]
+}
+
+func (h *dnsHandler) pacRuleCount() int {
+	h.pacMu.RLock()
+	defer h.pacMu.RUnlock()
+	return len(h.pacRules)
+}
+
+// fetchPac downloads the PAC rules from an http(s) URL, or reads them from
+// the TXT records of a name given as "txt:name", one or more rules per
+// string.
+func (h *dnsHandler) fetchPac(url string) (map[string]bool, error) {
+	if name, ok := strings.CutPrefix(url, "txt:"); ok {
+		ua := h.fetchRecordFromUpsteams(context.Background(), dns.Fqdn(name), dns.TypeTXT, h.defaultUpstreams(), nil)
+		var lines []string
+		for _, rr := range ua.rrs {
+			if txt, ok := rr.(*dns.TXT); ok {
+				for _, s := range txt.Txt {
+					lines = append(lines, strings.Fields(s)...)
+				}
+			}
+		}
+		if len(lines) == 0 {
+			return nil, fmt.Errorf("no TXT records for %s", name)
+		}
+		return parsePac(strings.NewReader(strings.Join(lines, "\n")))
+	}
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	rsp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", rsp.Status)
+	}
+	return parsePac(rsp.Body)
+}
+
+// refreshPac replaces the PAC rules with the ones fetched from url every
+// interval. Failed fetches keep the last known good rules.
+func (h *dnsHandler) refreshPac(url string, interval time.Duration) {
+	for range time.Tick(interval) {
+		rules, err := h.fetchPac(url)
+		if err != nil {
+			log.Printf("Failed to refresh pac from %s, keeping the current rules: %s", url, err)
+			continue
+		}
+		h.setPacRules(rules)
+	}
+}
+
+// readPac merges the rules of src into one set, rules listed more than once
+// counting once.
+func readPac(src RuleSource) (map[string]bool, error) {
+	data, err := src.Read()
+	if err != nil {
+		return nil, err
+	}
+	return parsePac(bytes.NewReader(data))
+}
+
+// reloadPac reads the pac rules of src again, keeping the current rules if
+// it fails to load.
+func (h *dnsHandler) reloadPac(src RuleSource) {
+	rules, err := readPac(src)
+	if err != nil {
+		log.Printf("Failed to reload pac from %s, keeping the current rules: %s", src, err)
+		return
+	}
+	h.setPacRules(rules)
+	log.Printf("Reloaded %d pac rules", len(rules))
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// pipeAddr is where queries of -pipe come from: the local host, over TCP so
+// that their answers are not truncated.
+var pipeAddr = &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+
+// pipeWriter writes the answer to a query read by -pipe.
+type pipeWriter struct {
+	out io.Writer
+	err error
+}
+
+func (w *pipeWriter) LocalAddr() net.Addr  { return pipeAddr }
+func (w *pipeWriter) RemoteAddr() net.Addr { return pipeAddr }
+
+func (w *pipeWriter) WriteMsg(m *dns.Msg) error {
+	buf, err := m.Pack()
+	if err != nil {
+		w.err = err
+		return err
+	}
+	_, err = w.Write(buf)
+	return err
+}
+
+func (w *pipeWriter) Write(b []byte) (int, error) {
+	n, err := w.out.Write(b)
+	if err != nil {
+		w.err = err
+	}
+	return n, err
+}
+
+func (w *pipeWriter) Close() error        { return nil }
+func (w *pipeWriter) TsigStatus() error   { return nil }
+func (w *pipeWriter) TsigTimersOnly(bool) {}
+func (w *pipeWriter) Hijack()             {}
+
+// servePipe resolves the single query in wire format read from in, without
+// a length prefix, and writes the answer in the same format to out.
+func (h *dnsHandler) servePipe(in io.Reader, out io.Writer) error {
+	data, err := io.ReadAll(in)
+	if err != nil {
+		return err
+	}
+	r := new(dns.Msg)
+	if err := r.Unpack(data); err != nil {
+		return fmt.Errorf("invalid query: %w", err)
+	}
+	w := &pipeWriter{out: out}
+	h.ServeDNS(w, r)
+	return w.err
+}
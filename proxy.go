@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/likexian/doh-go"
+	hdns "github.com/likexian/doh-go/dns"
+	"github.com/likexian/doh-go/provider/cloudflare"
+	"github.com/likexian/doh-go/provider/google"
+	"github.com/likexian/doh-go/provider/quad9"
+	"github.com/miekg/dns"
+	"golang.org/x/net/proxy"
+)
+
+// newProxyDialer returns the dialer of -proxy, given as
+// socks5://[user:password@]host:port.
+func newProxyDialer(rawURL string) (proxy.ContextDialer, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "socks5" && u.Scheme != "socks5h" {
+		return nil, fmt.Errorf("unsupported proxy scheme %q", u.Scheme)
+	}
+	d, err := proxy.FromURL(u, proxy.Direct)
+	if err != nil {
+		return nil, err
+	}
+	cd, ok := d.(proxy.ContextDialer)
+	if !ok {
+		return nil, fmt.Errorf("proxy %s cannot dial with a context", u.Host)
+	}
+	return cd, nil
+}
+
+// setProxy makes upstreams and DoH providers be queried through the proxy
+// at rawURL.
+func (h *dnsHandler) setProxy(rawURL string) error {
+	d, err := newProxyDialer(rawURL)
+	if err != nil {
+		return err
+	}
+	h.proxy = d
+	h.dohTransport = &http.Transport{DialContext: d.DialContext, ForceAttemptHTTP2: true}
+	return nil
+}
+
+// dohURLs are the JSON API endpoints of dohProviders.
+var dohURLs = map[int]string{
+	doh.Quad9Provider:      quad9.Upstream[quad9.DefaultProvides],
+	doh.CloudflareProvider: cloudflare.Upstream[cloudflare.DefaultProvides],
+	doh.GoogleProvider:     google.Upstream[google.DefaultProvides],
+}
+
+// proxiedProvider queries the JSON API of a DoH provider like the doh-go
+// client does, but over a transport of ours: the doh-go clients dial the
+// providers themselves, which would leak the queries past -proxy.
+type proxiedProvider struct {
+	name      string
+	url       string
+	transport http.RoundTripper
+}
+
+func (p *proxiedProvider) String() string {
+	return p.name
+}
+
+func (p *proxiedProvider) Query(ctx context.Context, d hdns.Domain, t hdns.Type) (*hdns.Response, error) {
+	return p.ECSQuery(ctx, d, t, "")
+}
+
+func (p *proxiedProvider) ECSQuery(ctx context.Context, d hdns.Domain, t hdns.Type, s hdns.ECS) (*hdns.Response, error) {
+	name, err := d.Punycode()
+	if err != nil {
+		return nil, err
+	}
+	params := url.Values{"name": {name}, "type": {strings.TrimSpace(string(t))}}
+	if ecs := strings.TrimSpace(string(s)); ecs != "" {
+		params.Set("edns_client_subnet", ecs)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.url+"?"+params.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/dns-json")
+	rsp, err := (&http.Client{Transport: p.transport}).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("doh: %s: bad status code: %d", p.name, rsp.StatusCode)
+	}
+	rr := &hdns.Response{Provider: p.name}
+	if err := json.NewDecoder(rsp.Body).Decode(rr); err != nil {
+		return nil, err
+	}
+	if rr.Status != 0 {
+		return rr, fmt.Errorf("doh: %s: failed response code %d", p.name, rr.Status)
+	}
+	return rr, nil
+}
+
+// exchangeViaProxy sends m over a TCP connection to addr tunnelled through
+// -proxy, wrapped in TLS for DNS over TLS upstreams. SOCKS5 proxies rarely
+// relay UDP, so plain upstreams are queried over TCP as well.
+func (h *dnsHandler) exchangeViaProxy(ctx context.Context, m *dns.Msg, addr string, overTLS bool) (*dns.Msg, time.Duration, error) {
+	if h.perUpstreamTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, h.perUpstreamTimeout)
+		defer cancel()
+	}
+	conn, err := h.proxy.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer conn.Close()
+	if overTLS {
+		conn = tls.Client(conn, h.tlsConfig(addr))
+	}
+	c := &dns.Client{Net: "tcp", Timeout: h.perUpstreamTimeout}
+	return c.ExchangeWithConnContext(ctx, m, &dns.Conn{Conn: conn})
+}
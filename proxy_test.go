@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/likexian/doh-go"
+	hdns "github.com/likexian/doh-go/dns"
+	"github.com/miekg/dns"
+)
+
+func TestProxySetForDoHProviders(t *testing.T) {
+	h := &dnsHandler{}
+	if err := h.setProxy("socks5://127.0.0.1:1080"); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range h.dohClients() {
+		if _, ok := p.(*proxiedProvider); !ok {
+			t.Errorf("DoH provider %s does not go through -proxy", p)
+		}
+	}
+}
+
+func TestProxiedProviderQuery(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Accept") != "application/dns-json" {
+			http.Error(w, "not json", http.StatusNotAcceptable)
+			return
+		}
+		status := dns.RcodeSuccess
+		if r.FormValue("name") == "gone.example.com." {
+			status = dns.RcodeNameError
+		}
+		fmt.Fprintf(w, `{"Status":%d,"Answer":[{"name":%q,"type":1,"TTL":300,"data":"192.0.2.1"}]}`, status, r.FormValue("name"))
+	}))
+	defer srv.Close()
+	p := &proxiedProvider{name: "test", url: srv.URL, transport: srv.Client().Transport}
+
+	rsp, err := p.Query(context.Background(), hdns.Domain("example.com."), hdns.TypeA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a := dohAnswer("example.com.", dns.TypeA, rsp); !a.hasType(dns.TypeA) {
+		t.Errorf("answered %v", rsp.Answer)
+	}
+	// a failure rcode is classified like those of the doh-go clients
+	_, err = queryProviders(context.Background(), []doh.Provider{p}, "gone.example.com.", dns.TypeA, false)
+	var status dohStatusError
+	if !errors.As(err, &status) || int(status) != dns.RcodeNameError {
+		t.Errorf("error %v, want the NXDOMAIN status", err)
+	}
+}
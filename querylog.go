@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// queryLog appends a line per answered query to a file, rotating it once it
+// grows beyond maxSize: the full file becomes path.1, the previous path.1
+// becomes path.2 and so on, dropping the files beyond maxFiles.
+type queryLog struct {
+	mu       sync.Mutex
+	path     string
+	maxSize  int64
+	maxFiles int
+	file     *os.File
+	size     int64
+}
+
+func openQueryLog(path string, maxSize int64, maxFiles int) (*queryLog, error) {
+	l := &queryLog{path: path, maxSize: maxSize, maxFiles: maxFiles}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *queryLog) open() error {
+	file, err := os.OpenFile(l.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	l.file, l.size = file, info.Size()
+	return nil
+}
+
+func (l *queryLog) rotate() error {
+	l.file.Close()
+	os.Remove(fmt.Sprintf("%s.%d", l.path, l.maxFiles))
+	for i := l.maxFiles - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", l.path, i), fmt.Sprintf("%s.%d", l.path, i+1))
+	}
+	if l.maxFiles > 0 {
+		os.Rename(l.path, l.path+".1")
+	} else {
+		os.Remove(l.path)
+	}
+	return l.open()
+}
+
+// log records the query r of client answered with m after latency.
+func (l *queryLog) log(client net.Addr, r, m *dns.Msg, latency time.Duration) {
+	if l == nil {
+		return
+	}
+	name, qtype := "-", "-"
+	if len(r.Question) > 0 {
+		name, qtype = r.Question[0].Name, dns.TypeToString[r.Question[0].Qtype]
+	}
+	line := fmt.Sprintf("%s %s %s %s %s %d %s\n", time.Now().Format(time.RFC3339), addrIP(client), name, qtype, dns.RcodeToString[m.Rcode], len(m.Answer), latency)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil && l.open() != nil {
+		// the query log resumes once it can be opened again
+		return
+	}
+	if l.size > 0 && l.size+int64(len(line)) > l.maxSize {
+		if err := l.rotate(); err != nil {
+			log.Printf("Failed to rotate query log %s: %s", l.path, err)
+			l.file = nil
+			return
+		}
+	}
+	n, _ := l.file.WriteString(line)
+	l.size += int64(n)
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// clientQuota counts the queries of every client over the day, for
+// -client-quota. Counts start over at local midnight, which also drops the
+// clients seen the day before.
+type clientQuota struct {
+	mu     sync.Mutex
+	limit  int
+	day    time.Time // midnight of the day counted
+	counts map[string]int
+}
+
+func newClientQuota(limit int) *clientQuota {
+	return &clientQuota{limit: limit, counts: make(map[string]int)}
+}
+
+// allow counts a query of ip and reports whether it is within the quota of
+// the day. A nil quota allows everything.
+func (q *clientQuota) allow(ip net.IP, now time.Time) bool {
+	if q == nil || ip == nil {
+		return true
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	y, m, d := now.Date()
+	if day := time.Date(y, m, d, 0, 0, 0, 0, now.Location()); !day.Equal(q.day) {
+		q.day = day
+		q.counts = make(map[string]int)
+	}
+	key := ip.String()
+	n := q.counts[key]
+	if n > q.limit {
+		return false
+	}
+	q.counts[key] = n + 1
+	if n == q.limit {
+		log.Printf("Client %s used up its quota of %d queries for today", key, q.limit)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// regexRule answers the names its pattern matches with a fixed address, or
+// with a CNAME to target when it names a domain instead.
+type regexRule struct {
+	pattern *regexp.Regexp
+	ip      net.IP
+	target  string
+}
+
+// regexRules are the rules of a -regex-rules file, tried in file order.
+type regexRules []regexRule
+
+// loadRegexRules reads "pattern ip-or-name" lines, the pattern matched
+// against lowercase query names without the trailing dot. Lines starting
+// with # are ignored.
+func loadRegexRules(path string) (regexRules, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var rules regexRules
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: want a pattern and an address or name", path, n)
+		}
+		pattern, err := regexp.Compile(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, n, err)
+		}
+		rule := regexRule{pattern: pattern, ip: net.ParseIP(fields[1])}
+		if rule.ip == nil {
+			if _, ok := dns.IsDomainName(fields[1]); !ok {
+				return nil, fmt.Errorf("%s:%d: %s is neither an address nor a name", path, n, fields[1])
+			}
+			rule.target = dns.Fqdn(strings.ToLower(fields[1]))
+		}
+		rules = append(rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// lookup returns the first rule matching name, a lowercase FQDN.
+func (rs regexRules) lookup(name string) (*regexRule, bool) {
+	name = strings.TrimSuffix(name, ".")
+	for i := range rs {
+		if rs[i].pattern.MatchString(name) {
+			return &rs[i], true
+		}
+	}
+	return nil, false
+}
+
+// answer returns the records of the rule for q: its address when of the
+// type asked for, nothing for other types, or its CNAME for every type.
+func (r *regexRule) answer(q dns.Question, ttl uint32) []dns.RR {
+	if r.ip != nil {
+		return pinnedRRs(q, []net.IP{r.ip}, ttl)
+	}
+	return []dns.RR{&dns.CNAME{
+		Hdr:    dns.RR_Header{Name: q.Name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: ttl},
+		Target: r.target,
+	}}
+}
+
+func (h *dnsHandler) regexRules() regexRules {
+	h.listsMu.RLock()
+	defer h.listsMu.RUnlock()
+	return h.regexes
+}
+
+// reloadRegexRules reads the regex rules again, keeping the loaded ones if
+// they fail to load.
+func (h *dnsHandler) reloadRegexRules(path string) {
+	rules, err := loadRegexRules(path)
+	if err != nil {
+		log.Printf("Failed to reload %s, keeping the loaded regex rules: %s", path, err)
+		return
+	}
+	h.listsMu.Lock()
+	h.regexes = rules
+	h.listsMu.Unlock()
+	log.Printf("Reloaded %d regex rules", len(rules))
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+type restRecord struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	TTL  uint32 `json:"ttl"`
+	Data string `json:"data"`
+}
+
+type restResponse struct {
+	Name    string       `json:"name"`
+	Type    string       `json:"type"`
+	Status  string       `json:"status"`
+	Answers []restRecord `json:"answers"`
+}
+
+// serveResolve handles GET /resolve?name=example.com&type=A.
+func (h *dnsHandler) serveResolve(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		http.Error(w, "missing name", http.StatusBadRequest)
+		return
+	}
+	typ := strings.ToUpper(r.URL.Query().Get("type"))
+	if typ == "" {
+		typ = "A"
+	}
+	qtype, ok := dns.StringToType[typ]
+	if !ok {
+		http.Error(w, "unknown type "+typ, http.StatusBadRequest)
+		return
+	}
+	rrs, rcode, err := h.resolve(r.Context(), dns.Fqdn(name), qtype)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	rsp := restResponse{Name: dns.Fqdn(name), Type: typ, Status: dns.RcodeToString[rcode], Answers: []restRecord{}}
+	for _, rr := range rrs {
+		hdr := rr.Header()
+		rsp.Answers = append(rsp.Answers, restRecord{
+			Name: hdr.Name,
+			Type: dns.TypeToString[hdr.Rrtype],
+			TTL:  hdr.Ttl,
+			Data: strings.TrimPrefix(rr.String(), hdr.String()),
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rsp)
+}
+
+func (h *dnsHandler) serveREST(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/resolve", h.serveResolve)
+	serveHTTP("REST queries", addr, mux)
+}
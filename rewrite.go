@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"math/rand"
+	"net"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// AnswerMiddleware inspects the answers resolved for q and returns the
+// answers to send instead. It may modify, drop or add records.
+type AnswerMiddleware func(q dns.Question, answers []dns.RR) []dns.RR
+
+// Use registers middlewares that parseQuery runs, in registration order, on
+// the answers of every question before they are returned.
+func (h *dnsHandler) Use(mw ...AnswerMiddleware) {
+	h.rewriters = append(h.rewriters, mw...)
+}
+
+// newIPRemapper returns a middleware replacing answer addresses according to
+// a file of "from-ip to-ip" lines. A mapping only applies within the same
+// address family.
+func newIPRemapper(path string) (AnswerMiddleware, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	remap := make(map[string]net.IP)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.Fields(line)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid line in remap file: %s", line)
+		}
+		from, to := net.ParseIP(parts[0]), net.ParseIP(parts[1])
+		if from == nil || to == nil || (from.To4() == nil) != (to.To4() == nil) {
+			return nil, fmt.Errorf("invalid addresses in remap file: %s", line)
+		}
+		remap[from.String()] = to
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return func(q dns.Question, answers []dns.RR) []dns.RR {
+		for i, rr := range answers {
+			switch a := rr.(type) {
+			case *dns.A:
+				if to, ok := remap[a.A.String()]; ok {
+					c := *a
+					c.A = to
+					answers[i] = &c
+				}
+			case *dns.AAAA:
+				if to, ok := remap[a.AAAA.String()]; ok {
+					c := *a
+					c.AAAA = to
+					answers[i] = &c
+				}
+			}
+		}
+		return answers
+	}, nil
+}
+
+// bogonNets are the ranges beyond net.IP's private, loopback, link-local and
+// unspecified checks that never belong to public names.
+var bogonNets = func() []*net.IPNet {
+	var nets []*net.IPNet
+	for _, cidr := range []string{"0.0.0.0/8", "100.64.0.0/10", "192.0.0.0/24", "198.18.0.0/15", "240.0.0.0/4"} {
+		_, n, _ := net.ParseCIDR(cidr)
+		nets = append(nets, n)
+	}
+	return nets
+}()
+
+func privateIP(ip net.IP) bool {
+	if ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsUnspecified() {
+		return true
+	}
+	for _, n := range bogonNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// newPrivateAnswerFilter returns a middleware dropping addresses in private
+// and bogon ranges from the answers of names not trusted, which defeats DNS
+// rebinding of public names onto the local network. A name left without
+// addresses is answered with NODATA.
+func newPrivateAnswerFilter(trusted func(name string) bool) AnswerMiddleware {
+	return func(q dns.Question, answers []dns.RR) []dns.RR {
+		if len(answers) == 0 || trusted(strings.ToLower(q.Name)) {
+			return answers
+		}
+		var kept []dns.RR
+		dropped, addrs := false, false
+		for _, rr := range answers {
+			switch a := rr.(type) {
+			case *dns.A:
+				if privateIP(a.A) {
+					dropped = true
+					continue
+				}
+				addrs = true
+			case *dns.AAAA:
+				if privateIP(a.AAAA) {
+					dropped = true
+					continue
+				}
+				addrs = true
+			}
+			kept = append(kept, rr)
+		}
+		if dropped && isDebug() {
+			log.Println(DEBUG_PREFIX, "dropped private addresses of", q.Name)
+		}
+		if dropped && !addrs {
+			return nil
+		}
+		return kept
+	}
+}
+
+// shuffleForClient reorders the records of type qtype among themselves in
+// an order fixed for every client and name, so that a client keeps getting
+// the same first address while different clients spread over all of them.
+func shuffleForClient(answers []dns.RR, qtype uint16, qname string, client net.IP) {
+	var idx []int
+	for i, rr := range answers {
+		if rr.Header().Rrtype == qtype {
+			idx = append(idx, i)
+		}
+	}
+	if len(idx) < 2 {
+		return
+	}
+	rrs := make([]dns.RR, len(idx))
+	for i, j := range idx {
+		rrs[i] = answers[j]
+	}
+	// upstreams may return the records in any order, start from a
+	// canonical one
+	sort.Slice(rrs, func(i, j int) bool { return rrs[i].String() < rrs[j].String() })
+	f := fnv.New64a()
+	f.Write(client.To16())
+	f.Write([]byte(strings.ToLower(qname)))
+	rand.New(rand.NewSource(int64(f.Sum64()))).Shuffle(len(rrs), func(i, j int) { rrs[i], rrs[j] = rrs[j], rrs[i] })
+	for i, j := range idx {
+		answers[j] = rrs[i]
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+type policyAction int
+
+const (
+	policyNXDOMAIN policyAction = iota // CNAME .
+	policyNODATA                       // CNAME *.
+	policyPassthru                     // CNAME rpz-passthru.
+	policyLocal                        // any other records, answered instead
+)
+
+type policyRule struct {
+	action policyAction
+	rrs    []dns.RR // the local data of policyLocal, owned by the trigger
+}
+
+// responsePolicy is a response policy zone (RPZ) with QNAME triggers: the
+// owner names of the zone, relative to its SOA, are the names the policies
+// apply to, "*." prefixed ones covering every subdomain.
+type responsePolicy struct {
+	exact    map[string]*policyRule
+	wildcard map[string]*policyRule // keyed by the name below the "*."
+}
+
+func loadResponsePolicy(path string) (*responsePolicy, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	p := &responsePolicy{exact: make(map[string]*policyRule), wildcard: make(map[string]*policyRule)}
+	var origin string
+	zp := dns.NewZoneParser(file, "", path)
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		owner := strings.ToLower(rr.Header().Name)
+		if soa, ok := rr.(*dns.SOA); ok && origin == "" {
+			origin = strings.ToLower(soa.Hdr.Name)
+			continue
+		}
+		if origin == "" {
+			return nil, fmt.Errorf("%s: records before the SOA", path)
+		}
+		if rr.Header().Rrtype == dns.TypeNS || owner == origin {
+			continue
+		}
+		if !dns.IsSubDomain(origin, owner) {
+			return nil, fmt.Errorf("%s: %s is outside of %s", path, owner, origin)
+		}
+		trigger := dns.Fqdn(strings.TrimSuffix(owner, "."+origin))
+		rules := p.exact
+		if rest, ok := strings.CutPrefix(trigger, "*."); ok {
+			trigger, rules = rest, p.wildcard
+		}
+		rule := rules[trigger]
+		if rule == nil {
+			rule = &policyRule{action: policyLocal}
+			rules[trigger] = rule
+		}
+		if cname, ok := rr.(*dns.CNAME); ok {
+			switch strings.ToLower(cname.Target) {
+			case ".":
+				rule.action = policyNXDOMAIN
+				continue
+			case "*.":
+				rule.action = policyNODATA
+				continue
+			case "rpz-passthru.":
+				rule.action = policyPassthru
+				continue
+			}
+		}
+		rule.rrs = append(rule.rrs, rr)
+	}
+	if err := zp.Err(); err != nil {
+		return nil, err
+	}
+	if origin == "" {
+		return nil, fmt.Errorf("%s: no SOA record", path)
+	}
+	return p, nil
+}
+
+// lookup returns the rule applying to name, preferring an exact trigger
+// over the wildcard of the closest parent domain.
+func (p *responsePolicy) lookup(name string) (*policyRule, bool) {
+	if p == nil {
+		return nil, false
+	}
+	if rule, ok := p.exact[name]; ok {
+		return rule, true
+	}
+	for {
+		i := strings.IndexByte(name, '.')
+		if i < 0 || i == len(name)-1 {
+			return nil, false
+		}
+		name = name[i+1:]
+		if rule, ok := p.wildcard[name]; ok {
+			return rule, true
+		}
+	}
+}
+
+// answer returns the local data of the rule for a query of type qtype,
+// with the owner set to qname. A CNAME answers every type.
+func (r *policyRule) answer(qname string, qtype uint16) []dns.RR {
+	var rrs []dns.RR
+	for _, rr := range r.rrs {
+		if t := rr.Header().Rrtype; t != qtype && t != dns.TypeCNAME {
+			continue
+		}
+		rr = dns.Copy(rr)
+		rr.Header().Name = qname
+		rrs = append(rrs, rr)
+	}
+	return rrs
+}
+
+func (h *dnsHandler) responsePolicy() *responsePolicy {
+	h.listsMu.RLock()
+	defer h.listsMu.RUnlock()
+	return h.policy
+}
+
+// reloadResponsePolicy reads the response policy zone again, keeping the
+// loaded one if it fails to load.
+func (h *dnsHandler) reloadResponsePolicy(path string) {
+	p, err := loadResponsePolicy(path)
+	if err != nil {
+		log.Printf("Failed to reload %s, keeping the loaded policies: %s", path, err)
+		return
+	}
+	h.listsMu.Lock()
+	h.policy = p
+	h.listsMu.Unlock()
+	log.Printf("Reloaded %d response policies", len(p.exact)+len(p.wildcard))
+}
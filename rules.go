@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RuleSource supplies a rule set, like the pac rules or a blocklist, in the
+// line format of its files. Sources are read again on every reload.
+type RuleSource interface {
+	Read() ([]byte, error)
+	String() string
+}
+
+// newRuleSource returns the source a -pac or list flag names: a Redis set
+// for redis:// URLs, files otherwise. Missing files are skipped when
+// optional.
+func newRuleSource(spec string, optional bool) (RuleSource, error) {
+	if spec == "" {
+		return nil, nil
+	}
+	if strings.HasPrefix(spec, "redis://") {
+		return newRedisSource(spec)
+	}
+	return &fileSource{paths: spec, optional: optional}, nil
+}
+
+// fileSource reads comma separated files, a directory standing for the
+// regular files in it.
+type fileSource struct {
+	paths    string
+	optional bool
+}
+
+func (s *fileSource) String() string { return s.paths }
+
+func (s *fileSource) Read() ([]byte, error) {
+	files, err := ruleFiles(s.paths)
+	if err != nil {
+		return nil, err
+	}
+	var rules []byte
+	for _, path := range files {
+		data, err := os.ReadFile(path)
+		if s.optional && os.IsNotExist(err) {
+			log.Printf("%s is not found.", path)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, data...)
+		rules = append(rules, '\n')
+	}
+	return rules, nil
+}
+
+// ruleFiles expands a comma separated list of paths into files, a directory
+// standing for the regular files in it, in name order.
+func ruleFiles(list string) ([]string, error) {
+	var files []string
+	for _, path := range strings.Split(list, ",") {
+		path = strings.TrimSpace(path)
+		if path == "" {
+			continue
+		}
+		if info, err := os.Stat(path); err != nil || !info.IsDir() {
+			// errors are left to the readers of the file
+			files = append(files, path)
+			continue
+		}
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			if e.Type().IsRegular() && !strings.HasPrefix(e.Name(), ".") {
+				files = append(files, filepath.Join(path, e.Name()))
+			}
+		}
+	}
+	return files, nil
+}
+
+// redisTimeout bounds the whole exchange with Redis.
+const redisTimeout = 10 * time.Second
+
+// redisSource reads the rules from the members of a Redis set, one rule per
+// member, given as redis://[:password@]host[:port][/db]?key=name.
+type redisSource struct {
+	addr, password, key string
+	db                  int
+}
+
+func newRedisSource(spec string) (*redisSource, error) {
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, err
+	}
+	s := &redisSource{addr: u.Host, key: u.Query().Get("key")}
+	if u.Port() == "" {
+		s.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if password, ok := u.User.Password(); ok {
+		s.password = password
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		if s.db, err = strconv.Atoi(db); err != nil {
+			return nil, fmt.Errorf("invalid database %q", db)
+		}
+	}
+	if s.key == "" {
+		return nil, errors.New("no ?key= naming the set of rules")
+	}
+	return s, nil
+}
+
+func (s *redisSource) String() string {
+	return fmt.Sprintf("redis %s/%d %s", s.addr, s.db, s.key)
+}
+
+func (s *redisSource) Read() ([]byte, error) {
+	conn, err := net.DialTimeout("tcp", s.addr, redisTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(redisTimeout))
+	r := bufio.NewReader(conn)
+	if s.password != "" {
+		if _, err := redisCommand(conn, r, "AUTH", s.password); err != nil {
+			return nil, err
+		}
+	}
+	if s.db != 0 {
+		if _, err := redisCommand(conn, r, "SELECT", strconv.Itoa(s.db)); err != nil {
+			return nil, err
+		}
+	}
+	reply, err := redisCommand(conn, r, "SMEMBERS", s.key)
+	if err != nil {
+		return nil, err
+	}
+	members, ok := reply.([]string)
+	if !ok {
+		return nil, fmt.Errorf("unexpected reply to SMEMBERS %s", s.key)
+	}
+	return []byte(strings.Join(members, "\n")), nil
+}
+
+// redisCommand sends a command in the RESP protocol and reads its reply: a
+// string, or a slice of strings for arrays.
+func redisCommand(w io.Writer, r *bufio.Reader, args ...string) (interface{}, error) {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := w.Write(b.Bytes()); err != nil {
+		return nil, err
+	}
+	return readRESP(r)
+}
+
+func readRESP(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("redis: empty reply")
+	}
+	switch line[0] {
+	case '+', ':':
+		return line[1:], nil
+	case '-':
+		return nil, fmt.Errorf("redis: %s", line[1:])
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		items := make([]string, 0, n)
+		for i := 0; i < n; i++ {
+			item, err := readRESP(r)
+			if err != nil {
+				return nil, err
+			}
+			if s, ok := item.(string); ok {
+				items = append(items, s)
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("redis: unexpected reply %q", line)
+}
+
+// loadRuleTable loads a blocklist or allowlist at startup.
+func loadRuleTable(kind string, src RuleSource) *hostsTable {
+	if src == nil {
+		return nil
+	}
+	start := time.Now()
+	data, err := src.Read()
+	if err != nil {
+		log.Fatalf("Failed to read %s from %s: %s", kind, src, err)
+	}
+	t := parseHostsTable(data)
+	log.Printf("Loaded %d %s entries in %s", t.len(), kind, time.Since(start))
+	return t
+}
+
+// refreshRules reloads the pac rules and the lists every interval, for
+// sources like Redis that change without the process being signalled.
+func (h *dnsHandler) refreshRules(pac, blocklist, allowlist RuleSource, interval time.Duration) {
+	for range time.Tick(interval) {
+		if pac != nil {
+			h.reloadPac(pac)
+		}
+		if blocklist != nil || allowlist != nil {
+			h.reloadLists(blocklist, allowlist)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	hdns "github.com/likexian/doh-go/dns"
+	"github.com/miekg/dns"
+)
+
+// Default upstream lists, shared by the server and test-upstreams.
+const (
+	defaultUpstreamList    = "114.114.114.114:53,8.8.8.8:53"
+	defaultPacUpstreamList = "8.8.8.8:53,8.8.4.4:53,1.1.1.1:53,114.114.114.114:53"
+)
+
+// runTestUpstreams implements the "test-upstreams" subcommand, querying a
+// well-known name from every upstream the server would use and printing
+// which answer and how fast. It exits with 1 when a plain or pac upstream
+// fails, or every DoH provider does.
+func runTestUpstreams(args []string) {
+	fs := flag.NewFlagSet("test-upstreams", flag.ExitOnError)
+	var src upstreamSources
+	fs.StringVar(&src.upstreams, "upstreams", defaultUpstreamList, "upstreams as given to the server")
+	fs.StringVar(&src.pacUpstreams, "pac-upstreams", defaultPacUpstreamList, "pac upstreams as given to the server")
+	fs.StringVar(&src.file, "upstreams-file", "", "The file path to upstream lists overriding the flags, as given to the server")
+	fs.StringVar(&src.resolvConf, "resolv-conf", "", "The file path to a resolv.conf overriding -upstreams, as given to the server")
+	name := fs.String("name", "example.com", "the name to query, which must have an A record")
+	timeout := fs.Duration("timeout", 2*time.Second, "how long an upstream may take to answer")
+	noDoH := fs.Bool("no-doh", false, "skip the DNS over HTTPS providers")
+	proxyURL := fs.String("proxy", "", "socks5:// proxy upstreams and DoH providers are queried through, as given to the server")
+	tlsServerNames := fs.String("upstream-tls-servername", "", "host:port@name of tls:// upstreams, as given to the server")
+	tlsPins := fs.String("upstream-tls-pin", "", "host:port@sha256 of tls:// upstreams, as given to the server")
+	fs.Parse(args)
+
+	conf, err := loadUpstreamConfig(src)
+	if err != nil {
+		log.Fatal("Invalid upstreams: ", err)
+	}
+	h := &dnsHandler{perUpstreamTimeout: *timeout}
+	if *proxyURL != "" {
+		if err = h.setProxy(*proxyURL); err != nil {
+			log.Fatalf("Invalid -proxy: %s", err)
+		}
+	}
+	if h.tlsServerNames, err = parseTLSServerNames(*tlsServerNames); err != nil {
+		log.Fatalf("Invalid -upstream-tls-servername: %s", err)
+	}
+	if h.tlsPins, err = parseTLSPins(*tlsPins); err != nil {
+		log.Fatalf("Invalid -upstream-tls-pin: %s", err)
+	}
+	qname := dns.Fqdn(*name)
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "UPSTREAM\tROLE\tRESULT\tRTT\tDETAIL")
+	failed := false
+	report := func(upstream, role string, rtt time.Duration, err error) {
+		result := "ok"
+		detail := ""
+		if err != nil {
+			result, detail = "FAIL", err.Error()
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", upstream, role, result, rtt.Round(10*time.Microsecond), detail)
+	}
+	test := func(upstreams []string, role string) {
+		for _, us := range upstreams {
+			m := new(dns.Msg)
+			m.SetQuestion(qname, dns.TypeA)
+			start := time.Now()
+			r, _, err := h.exchange(context.Background(), m, us)
+			if err == nil {
+				err = checkTestAnswer(r.Rcode, len(onlyType(r.Answer, dns.TypeA)))
+			}
+			failed = failed || err != nil
+			report(us, role, time.Since(start), err)
+		}
+	}
+	test(conf.plain.addrs, "upstream")
+	test(conf.pac.addrs, "pac")
+	var listeners []string
+	for listener := range conf.byListener {
+		listeners = append(listeners, listener)
+	}
+	sort.Strings(listeners)
+	for _, listener := range listeners {
+		test(conf.byListener[listener].addrs, "listener "+listener)
+	}
+	if !*noDoH {
+		answered := false
+		for _, p := range h.dohClients() {
+			ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+			start := time.Now()
+			rsp, err := p.Query(ctx, hdns.Domain(qname), hdns.TypeA)
+			cancel()
+			if err == nil {
+				err = checkTestAnswer(rsp.Status, len(onlyType(dohAnswer(qname, dns.TypeA, rsp).rrs, dns.TypeA)))
+			}
+			answered = answered || err == nil
+			report(p.String(), "doh", time.Since(start), err)
+		}
+		failed = failed || !answered
+	}
+	tw.Flush()
+	if failed {
+		os.Exit(1)
+	}
+}
+
+func checkTestAnswer(rcode, records int) error {
+	if rcode != dns.RcodeSuccess {
+		return fmt.Errorf("answered %s", dns.RcodeToString[rcode])
+	}
+	if records == 0 {
+		return fmt.Errorf("no A record")
+	}
+	return nil
+}
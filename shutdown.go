@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// drain stops the servers from accepting queries, then waits for the
+// queries in flight to be answered until ctx is done, so that clients of a
+// restarting instance get their answers instead of errors.
+func (h *dnsHandler) drain(ctx context.Context, servers []*dns.Server, doh *http.Server) {
+	var wg sync.WaitGroup
+	for _, s := range servers {
+		wg.Add(1)
+		go func(s *dns.Server) {
+			defer wg.Done()
+			s.ShutdownContext(ctx)
+		}(s)
+	}
+	if doh != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			doh.Shutdown(ctx)
+		}()
+	}
+	wg.Wait()
+	answered := make(chan struct{})
+	go func() {
+		h.inflight.Wait()
+		close(answered)
+	}()
+	select {
+	case <-answered:
+	case <-ctx.Done():
+		log.Printf("Queries still in flight after -shutdown-timeout, exiting anyway")
+	}
+}
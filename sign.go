@@ -0,0 +1,112 @@
+package main
+
+import (
+	"crypto"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// signatureValidity is how long generated signatures stay valid. They are
+// made on every answer, so this only needs to cover clock skew and caching.
+const signatureValidity = 24 * time.Hour
+
+// zoneSigner signs answers within a local zone with one key, so that
+// clients trusting the key can validate them. Denial of existence is not
+// signed: NXDOMAIN and NODATA answers carry no NSEC records.
+type zoneSigner struct {
+	zone string // lowercase and fully qualified
+	key  *dns.DNSKEY
+	priv crypto.Signer
+}
+
+// loadZoneSigner reads a key pair in the BIND format, where keyPath is the
+// common prefix of the .key and .private files written by dnssec-keygen.
+func loadZoneSigner(zone, keyPath string) (*zoneSigner, error) {
+	zone = dns.Fqdn(strings.ToLower(zone))
+	pub, err := os.Open(keyPath + ".key")
+	if err != nil {
+		return nil, err
+	}
+	defer pub.Close()
+	rr, err := dns.ReadRR(pub, keyPath+".key")
+	if err != nil {
+		return nil, err
+	}
+	key, ok := rr.(*dns.DNSKEY)
+	if !ok {
+		return nil, fmt.Errorf("%s.key holds no DNSKEY record", keyPath)
+	}
+	if !strings.EqualFold(key.Hdr.Name, zone) {
+		return nil, fmt.Errorf("key belongs to %s, not %s", key.Hdr.Name, zone)
+	}
+	key.Hdr.Name = zone
+	private, err := os.Open(keyPath + ".private")
+	if err != nil {
+		return nil, err
+	}
+	defer private.Close()
+	priv, err := key.ReadPrivateKey(private, keyPath+".private")
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := priv.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key algorithm %s", dns.AlgorithmToString[key.Algorithm])
+	}
+	return &zoneSigner{zone: zone, key: key, priv: signer}, nil
+}
+
+func (s *zoneSigner) covers(name string) bool {
+	return s != nil && dns.IsSubDomain(s.zone, strings.ToLower(name))
+}
+
+// dnskey answers a DNSKEY query for the apex of the zone.
+func (s *zoneSigner) dnskey(ttl uint32) []dns.RR {
+	key := *s.key
+	key.Hdr.Ttl = ttl
+	return []dns.RR{&key}
+}
+
+// sign appends an RRSIG to every RRset of rrs owned by a name in the zone.
+// Records outside of it, like the tail of a CNAME chain leaving the zone,
+// are passed on unsigned.
+func (s *zoneSigner) sign(rrs []dns.RR) ([]dns.RR, error) {
+	type rrsetKey struct {
+		name  string
+		rtype uint16
+	}
+	var order []rrsetKey
+	sets := make(map[rrsetKey][]dns.RR)
+	for _, rr := range rrs {
+		h := rr.Header()
+		if h.Rrtype == dns.TypeRRSIG || !s.covers(h.Name) {
+			continue
+		}
+		k := rrsetKey{strings.ToLower(h.Name), h.Rrtype}
+		if sets[k] == nil {
+			order = append(order, k)
+		}
+		sets[k] = append(sets[k], rr)
+	}
+	now := time.Now()
+	for _, k := range order {
+		set := sets[k]
+		sig := &dns.RRSIG{
+			Hdr:        dns.RR_Header{Name: set[0].Header().Name, Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: set[0].Header().Ttl},
+			Algorithm:  s.key.Algorithm,
+			KeyTag:     s.key.KeyTag(),
+			SignerName: s.zone,
+			Inception:  uint32(now.Add(-time.Hour).Unix()),
+			Expiration: uint32(now.Add(signatureValidity).Unix()),
+		}
+		if err := sig.Sign(s.priv, set); err != nil {
+			return rrs, err
+		}
+		rrs = append(rrs, sig)
+	}
+	return rrs, nil
+}
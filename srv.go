@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// maxSRVTargets bounds the SRV targets resolved for the additional section
+// of one answer.
+const maxSRVTargets = 8
+
+// srvAdditionals resolves the addresses of the targets of the SRV records
+// in answers for the additional section, sparing clients a second round
+// trip. Targets are resolved concurrently within what is left of the query
+// budget, those failing are left out.
+func (h *dnsHandler) srvAdditionals(ctx context.Context, answers []dns.RR) []dns.RR {
+	seen := make(map[string]bool)
+	var targets []string
+	for _, rr := range answers {
+		srv, ok := rr.(*dns.SRV)
+		if !ok || srv.Target == "." || seen[strings.ToLower(srv.Target)] || len(targets) == maxSRVTargets {
+			continue
+		}
+		seen[strings.ToLower(srv.Target)] = true
+		targets = append(targets, srv.Target)
+	}
+	if len(targets) == 0 {
+		return nil
+	}
+	req := h.requestFrom(ctx)
+	fctx, cancel, ok := req.followUp(ctx)
+	if !ok {
+		return nil
+	}
+	defer cancel()
+	qtypes := []uint16{dns.TypeA, dns.TypeAAAA}
+	found := make([][]dns.RR, len(targets)*len(qtypes))
+	var wg sync.WaitGroup
+	for i, target := range targets {
+		for j, qtype := range qtypes {
+			wg.Add(1)
+			go func(k int, target string, qtype uint16) {
+				defer wg.Done()
+				// a request of its own, what the resolutions gather is
+				// not relayed to the client. Appending to the options of
+				// the copy would write to the spare capacity of the
+				// parent's, shared by every goroutine
+				sub := *req
+				sub.replyOpts = nil
+				rrs, rcode, err := h.resolve(withRequest(fctx, &sub), target, qtype)
+				if err == nil && rcode == dns.RcodeSuccess {
+					found[k] = onlyType(rrs, qtype)
+				}
+			}(i*len(qtypes)+j, target, qtype)
+		}
+	}
+	wg.Wait()
+	var extra []dns.RR
+	for _, rrs := range found {
+		extra = append(extra, rrs...)
+	}
+	return extra
+}
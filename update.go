@@ -0,0 +1,57 @@
+package main
+
+import (
+	"log"
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// updateTimeout bounds the exchange of an update with -update-upstream.
+const updateTimeout = 5 * time.Second
+
+// acceptUpdates lets UPDATE messages through to the handler, which dns.Server
+// otherwise rejects as not implemented. Their sections hold the zone,
+// prerequisites and updates, so the counts checked for queries do not apply.
+func acceptUpdates(dh dns.Header) dns.MsgAcceptAction {
+	if int(dh.Bits>>11)&0xF == dns.OpcodeUpdate {
+		return dns.MsgAccept
+	}
+	return dns.DefaultMsgAcceptFunc(dh)
+}
+
+func (h *dnsHandler) updateAllowed(addr net.Addr) bool {
+	ip := addrIP(addr)
+	for _, n := range h.updateClients {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardUpdate relays the dynamic update r to -update-upstream and returns
+// its answer, or m with the rcode of why r was not relayed. The update is
+// packed anew, so TSIG signatures do not survive the relay.
+func (h *dnsHandler) forwardUpdate(client net.Addr, r, m *dns.Msg) *dns.Msg {
+	if h.updateUpstream == "" {
+		m.Rcode = dns.RcodeNotImplemented
+		return m
+	}
+	if !h.updateAllowed(client) {
+		if isDebug() {
+			log.Println(DEBUG_PREFIX, "refused update from", client)
+		}
+		m.Rcode = dns.RcodeRefused
+		return m
+	}
+	c := &dns.Client{Net: "tcp", Timeout: updateTimeout}
+	resp, _, err := c.Exchange(r, h.updateUpstream)
+	if err != nil {
+		log.Printf("Error forwarding update from %s: %s", addrIP(client), err)
+		m.Rcode = dns.RcodeServerFailure
+		return m
+	}
+	return resp
+}
@@ -0,0 +1,452 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"math/rand"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// tlsScheme prefixes upstreams queried over DNS over TLS.
+const tlsScheme = "tls://"
+
+// orderUpstreams returns the order in which the upstreams of list are tried
+// for name, according to -upstream-mode.
+func (h *dnsHandler) orderUpstreams(name string, list *upstreamList) []string {
+	upstreams := list.addrs
+	if len(upstreams) < 2 {
+		return upstreams
+	}
+	switch h.upstreamMode {
+	case "hash":
+		return hashedUpstreams(name, upstreams)
+	case "fastest":
+		return h.fastestUpstreams(upstreams)
+	case "failover-sticky":
+		return stickyUpstreams(list)
+	}
+	return weightedUpstreams(list)
+}
+
+// hashedUpstreams maps every name to its own ranking of the upstreams by
+// rendezvous hashing, so repeated queries for a name land on the same
+// upstream and keep its cache warm, and removing an upstream only moves the
+// names that ranked it first.
+func hashedUpstreams(name string, upstreams []string) []string {
+	weights := make(map[string]uint64, len(upstreams))
+	for _, us := range upstreams {
+		f := fnv.New64a()
+		f.Write([]byte(us))
+		f.Write([]byte{0})
+		f.Write([]byte(name))
+		weights[us] = mix64(f.Sum64())
+	}
+	ordered := append([]string(nil), upstreams...)
+	sort.Slice(ordered, func(i, j int) bool { return weights[ordered[i]] > weights[ordered[j]] })
+	return ordered
+}
+
+// fastestUpstreams orders upstreams by their moving average round trip time,
+// failures counting as slow answers. Upstreams not queried yet come first so
+// that they get measured.
+func (h *dnsHandler) fastestUpstreams(upstreams []string) []string {
+	avg := make(map[string]time.Duration, len(upstreams))
+	for _, us := range upstreams {
+		avg[us] = h.upstreamStats.average(us)
+	}
+	ordered := append([]string(nil), upstreams...)
+	sort.SliceStable(ordered, func(i, j int) bool { return avg[ordered[i]] < avg[ordered[j]] })
+	return ordered
+}
+
+// weightedUpstreams picks the first upstream of list at random in proportion
+// to their weights in list (1 by default) once any is given one, the others
+// follow in list order.
+func weightedUpstreams(list *upstreamList) []string {
+	upstreams, weights := list.addrs, list.weights
+	if len(weights) == 0 {
+		return upstreams
+	}
+	weight := func(us string) int {
+		if w, ok := weights[us]; ok {
+			return w
+		}
+		return 1
+	}
+	total := 0
+	for _, us := range upstreams {
+		total += weight(us)
+	}
+	n := rand.Intn(total)
+	for i, us := range upstreams {
+		if n -= weight(us); n < 0 {
+			return append(append([]string(nil), upstreams[i:]...), upstreams[:i]...)
+		}
+	}
+	return upstreams
+}
+
+// stickyUpstreams starts from the upstream of list that answered last,
+// followed by the ones after it in list order, so that every name goes to
+// the same upstream until it fails.
+func stickyUpstreams(list *upstreamList) []string {
+	upstreams := list.addrs
+	sticky := list.sticky.Load()
+	if sticky == nil {
+		return upstreams
+	}
+	for i, us := range upstreams {
+		if us == *sticky {
+			return append(append([]string(nil), upstreams[i:]...), upstreams[:i]...)
+		}
+	}
+	return upstreams
+}
+
+// stickTo makes us the upstream of l tried first from now on.
+func (l *upstreamList) stickTo(us string) {
+	old := l.sticky.Load()
+	if old != nil && *old == us {
+		return
+	}
+	l.sticky.Store(&us)
+	if old != nil {
+		log.Printf("Sticking to upstream %s of %v instead of %s", us, l, *old)
+	}
+}
+
+// mix64 is the splitmix64 finalizer, spreading the last bytes hashed by
+// FNV over all bits so that rankings are evenly distributed.
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	return x ^ x>>31
+}
+
+// exchange sends m to the upstream us, over DNS over TLS for tls:// ones.
+func (h *dnsHandler) exchange(ctx context.Context, m *dns.Msg, us string) (*dns.Msg, time.Duration, error) {
+	addr, overTLS := strings.CutPrefix(us, tlsScheme)
+	if overTLS {
+		m = padQuery(m, h.padding)
+	}
+	if h.proxy != nil {
+		return h.exchangeViaProxy(ctx, m, addr, overTLS)
+	}
+	c := &dns.Client{Timeout: h.perUpstreamTimeout}
+	if overTLS {
+		c.Net = "tcp-tls"
+		c.TLSConfig = h.tlsConfig(addr)
+	}
+	return c.ExchangeContext(ctx, m, addr)
+}
+
+// tlsConfig returns the TLS configuration of the DNS over TLS upstream at
+// addr, verifying the name -upstream-tls-servername gives it, if any, and
+// its host otherwise.
+func (h *dnsHandler) tlsConfig(addr string) *tls.Config {
+	name, ok := h.tlsServerNames[addr]
+	if !ok {
+		name, _, _ = net.SplitHostPort(addr)
+	}
+	conf := &tls.Config{ServerName: name}
+	if pins, ok := h.tlsPins[addr]; ok {
+		conf.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			return checkPins(addr, rawCerts, pins)
+		}
+	}
+	return conf
+}
+
+// checkPins returns an error unless a certificate the upstream at addr
+// presented has a public key of pins, so that even a certificate issued by
+// a trusted authority is refused for a key other than the expected one.
+func checkPins(addr string, rawCerts [][]byte, pins [][]byte) error {
+	for _, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			continue
+		}
+		sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		for _, pin := range pins {
+			if bytes.Equal(sum[:], pin) {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("no certificate of %s matches its -upstream-tls-pin", addr)
+}
+
+// parseTLSPins parses the comma separated host:port@pin list of
+// -upstream-tls-pin, a pin being the base64 SHA-256 hash of a public key
+// (SPKI). An upstream may be listed with several pins, like its current
+// and its next key. Pins only apply to tls:// upstreams: the doh-go client
+// makes a transport of its own for every query, which leaves no way to
+// verify the keys of the DoH providers.
+func parseTLSPins(list string) (map[string][][]byte, error) {
+	pins := make(map[string][][]byte)
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		addr, pin, ok := strings.Cut(strings.TrimPrefix(entry, tlsScheme), "@")
+		if _, _, err := net.SplitHostPort(addr); !ok || err != nil {
+			return nil, fmt.Errorf("%q is not host:port@pin", entry)
+		}
+		sum, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(pin, "sha256/"))
+		if err != nil || len(sum) != sha256.Size {
+			return nil, fmt.Errorf("%q is not a base64 SHA-256 hash", pin)
+		}
+		pins[addr] = append(pins[addr], sum)
+	}
+	return pins, nil
+}
+
+// parseTLSServerNames parses the comma separated host:port@name list of
+// -upstream-tls-servername.
+func parseTLSServerNames(list string) (map[string]string, error) {
+	names := make(map[string]string)
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		addr, name, ok := strings.Cut(strings.TrimPrefix(entry, tlsScheme), "@")
+		if _, _, err := net.SplitHostPort(addr); !ok || name == "" || err != nil {
+			return nil, fmt.Errorf("%q is not host:port@name", entry)
+		}
+		names[addr] = name
+	}
+	return names, nil
+}
+
+// padQuery returns a copy of m carrying an EDNS0 padding option that brings
+// its length to a multiple of block, so that the length of an encrypted
+// query says less about the name queried.
+func padQuery(m *dns.Msg, block int) *dns.Msg {
+	if block <= 0 {
+		return m
+	}
+	p := m.Copy()
+	opt := p.IsEdns0()
+	if opt == nil {
+		p.SetEdns0(dns.DefaultMsgSize, false)
+		opt = p.IsEdns0()
+	}
+	// the option code and length take 4 bytes of their own
+	size := p.Len() + 4
+	opt.Option = append(opt.Option, &dns.EDNS0_PADDING{Padding: make([]byte, (block-size%block)%block)})
+	return p
+}
+
+// upstreamConfig holds every upstream list. It is replaced as a whole on
+// reload, so a query in flight keeps using either the old lists or the new
+// ones, never a mix.
+type upstreamConfig struct {
+	plain      *upstreamList            // names without a pac rule
+	pac        *upstreamList            // pac names when DoH fails
+	byListener map[string]*upstreamList // keyed by the local address queries arrive on
+}
+
+// upstreamList is one of the configured lists of upstreams. An upstream in
+// several lists is weighted in each by the |weight it is given there.
+type upstreamList struct {
+	addrs   []string
+	weights map[string]int
+	// the upstream that answered last, tried first by -upstream-mode
+	// failover-sticky until a reload replaces the list
+	sticky atomic.Pointer[string]
+}
+
+func (l *upstreamList) String() string {
+	return fmt.Sprint(l.addrs)
+}
+
+// newUpstreamList parses a list formatted like -upstreams.
+func newUpstreamList(list string) (*upstreamList, error) {
+	l := &upstreamList{weights: make(map[string]int)}
+	var err error
+	if l.addrs, err = parseUpstreams(list, l.weights); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// upstreamSources are where the upstream lists are read from.
+type upstreamSources struct {
+	upstreams, pacUpstreams string // the flags
+	file                    string // -upstreams-file, overriding the flags
+	resolvConf              string // overriding the plain upstreams
+	listeners               string // -listener-upstreams
+}
+
+func loadUpstreamConfig(src upstreamSources) (*upstreamConfig, error) {
+	conf := &upstreamConfig{}
+	plain, pac := src.upstreams, src.pacUpstreams
+	plainFrom, pacFrom := "-upstreams", "-pac-upstreams"
+	if src.file != "" {
+		lists, err := readUpstreamsFile(src.file)
+		if err != nil {
+			return nil, err
+		}
+		if list, ok := lists["upstreams"]; ok {
+			plain, plainFrom = list, src.file
+		}
+		if list, ok := lists["pac-upstreams"]; ok {
+			pac, pacFrom = list, src.file
+		}
+	}
+	var err error
+	if src.resolvConf != "" {
+		conf.plain = &upstreamList{}
+		if conf.plain.addrs, err = readResolvConf(src.resolvConf); err != nil {
+			return nil, fmt.Errorf("-resolv-conf: %w", err)
+		}
+	} else if conf.plain, err = newUpstreamList(plain); err != nil {
+		return nil, fmt.Errorf("%s: %w", plainFrom, err)
+	}
+	if conf.pac, err = newUpstreamList(pac); err != nil {
+		return nil, fmt.Errorf("%s: %w", pacFrom, err)
+	}
+	if conf.byListener, err = readListenerUpstreams(src.listeners); err != nil {
+		return nil, err
+	}
+	return conf, nil
+}
+
+// readUpstreamsFile reads "upstreams list" and "pac-upstreams list" lines,
+// lists being formatted like the flags of the same names.
+func readUpstreamsFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	lists := make(map[string]string)
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, list, _ := strings.Cut(line, " ")
+		if key != "upstreams" && key != "pac-upstreams" {
+			return nil, fmt.Errorf("invalid line in %s: %s", path, line)
+		}
+		lists[key] = strings.TrimSpace(list)
+	}
+	return lists, nil
+}
+
+// readListenerUpstreams reads the upstream groups of -listener-upstreams,
+// one "ip[:port] upstream,..." per line.
+func readListenerUpstreams(path string) (map[string]*upstreamList, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	byListener := make(map[string]*upstreamList)
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.Fields(line)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid line in %s: %s", path, line)
+		}
+		upstreams, err := newUpstreamList(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		byListener[parts[0]] = upstreams
+	}
+	return byListener, nil
+}
+
+func (h *dnsHandler) upstreamConfig() *upstreamConfig {
+	return h.upstreams.Load()
+}
+
+// reloadUpstreams rereads every upstream list, keeping the current ones if
+// any fails to load.
+func (h *dnsHandler) reloadUpstreams(src upstreamSources) {
+	conf, err := loadUpstreamConfig(src)
+	if err != nil {
+		log.Printf("Failed to reload upstreams, keeping the current ones: %s", err)
+		return
+	}
+	h.upstreams.Store(conf)
+	log.Printf("Reloaded upstreams %v, pac upstreams %v", conf.plain, conf.pac)
+}
+
+// defaultUpstreams returns the plain upstreams serving clients without
+// upstreams of their own.
+func (h *dnsHandler) defaultUpstreams() *upstreamList {
+	return h.upstreamConfig().plain
+}
+
+// readResolvConf returns the nameservers of a resolv.conf as upstreams.
+func readResolvConf(path string) ([]string, error) {
+	conf, err := dns.ClientConfigFromFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var upstreams []string
+	for _, server := range conf.Servers {
+		upstreams = append(upstreams, net.JoinHostPort(server, conf.Port))
+	}
+	if len(upstreams) == 0 {
+		return nil, fmt.Errorf("no nameservers in %s", path)
+	}
+	return upstreams, nil
+}
+
+// upstreamLog writes the JSON lines of -log-upstreams, which carry their
+// own timestamp.
+var upstreamLog = log.New(os.Stderr, "", 0)
+
+type upstreamQueryLog struct {
+	Time     time.Time `json:"time"`
+	Name     string    `json:"name"`
+	Type     string    `json:"type"`
+	Upstream string    `json:"upstream"`
+	RTTMs    float64   `json:"rtt_ms"`
+	Rcode    string    `json:"rcode,omitempty"`
+	Error    string    `json:"error,omitempty"`
+}
+
+func logUpstreamQuery(name string, qtype uint16, upstream string, rtt time.Duration, r *dns.Msg, err error) {
+	entry := upstreamQueryLog{
+		Time:     time.Now(),
+		Name:     name,
+		Type:     dns.TypeToString[qtype],
+		Upstream: upstream,
+		RTTMs:    float64(rtt) / float64(time.Millisecond),
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	} else if r != nil {
+		entry.Rcode = dns.RcodeToString[r.Rcode]
+	}
+	line, _ := json.Marshal(entry)
+	upstreamLog.Println(string(line))
+}
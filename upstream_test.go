@@ -0,0 +1,45 @@
+package main
+
+import "testing"
+
+func TestUpstreamWeightsPerList(t *testing.T) {
+	conf, err := loadUpstreamConfig(upstreamSources{
+		upstreams:    "192.0.2.1:53|1000,192.0.2.2:53",
+		pacUpstreams: "192.0.2.2:53|1000,192.0.2.1:53",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// each list first picks the upstream weighted in it, not the one the
+	// other list weights
+	for _, tt := range []struct {
+		list  *upstreamList
+		first string
+	}{
+		{conf.plain, "192.0.2.1:53"},
+		{conf.pac, "192.0.2.2:53"},
+	} {
+		picked := 0
+		for i := 0; i < 100; i++ {
+			if weightedUpstreams(tt.list)[0] == tt.first {
+				picked++
+			}
+		}
+		if picked < 90 {
+			t.Errorf("%v: %s first %d times in 100, want nearly always", tt.list, tt.first, picked)
+		}
+	}
+}
+
+func TestStickyUpstreamPerList(t *testing.T) {
+	plain := &upstreamList{addrs: []string{"192.0.2.1:53", "192.0.2.2:53"}}
+	pac := &upstreamList{addrs: []string{"192.0.2.1:53", "192.0.2.2:53"}}
+	plain.stickTo("192.0.2.2:53")
+	pac.stickTo("192.0.2.1:53")
+	if first := stickyUpstreams(plain)[0]; first != "192.0.2.2:53" {
+		t.Errorf("plain list starts from %s, want the one it stuck to", first)
+	}
+	if first := stickyUpstreams(pac)[0]; first != "192.0.2.1:53" {
+		t.Errorf("pac list starts from %s, want the one it stuck to", first)
+	}
+}
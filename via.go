@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// viaLabel separates the name to resolve from the upstream in via hints.
+const viaLabel = ".via."
+
+// viaHint splits a name like "example.com.via.8-8-8-8." into the name to
+// resolve and the upstream to ask, "8.8.8.8:53". A fifth number sets the
+// port, as in "via.127-0-0-1-5353".
+func viaHint(qname string) (name, upstream string, ok bool) {
+	i := strings.LastIndex(strings.ToLower(qname), viaLabel)
+	if i <= 0 {
+		return "", "", false
+	}
+	parts := strings.Split(strings.TrimSuffix(qname[i+len(viaLabel):], "."), "-")
+	port := "53"
+	if len(parts) == 5 {
+		port, parts = parts[4], parts[:4]
+	}
+	ip := net.ParseIP(strings.Join(parts, "."))
+	if len(parts) != 4 || ip == nil {
+		return "", "", false
+	}
+	if n, err := strconv.ParseUint(port, 10, 16); err != nil || n == 0 {
+		return "", "", false
+	}
+	return dns.Fqdn(qname[:i]), net.JoinHostPort(ip.String(), port), true
+}
+
+// resolveVia asks upstream directly for name, bypassing the cache and the
+// routing rules, and answers in the spelling of qname.
+func (h *dnsHandler) resolveVia(ctx context.Context, qname, name string, qtype uint16, upstream string) ([]dns.RR, int, error) {
+	req := h.requestFrom(ctx)
+	ua := h.fetchRecordFromUpsteams(ctx, name, qtype, &upstreamList{addrs: []string{upstream}}, req.opts)
+	if ua.err != nil {
+		return nil, dns.RcodeServerFailure, ua.err
+	}
+	for _, rr := range ua.rrs {
+		if strings.EqualFold(rr.Header().Name, name) {
+			rr.Header().Name = qname
+		}
+	}
+	return ua.rrs, ua.rcode, nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// warmUp resolves the A records of domains into the cache using a pool of
+// workers, returning once all of them are done.
+func (h *dnsHandler) warmUp(domains []string, workers int) {
+	if workers < 1 {
+		workers = 1
+	}
+	start := time.Now()
+	names := make(chan string)
+	req := &request{upstreams: h.defaultUpstreams()}
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	resolved := 0
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for name := range names {
+				ua := h.fetch(context.Background(), name, dns.TypeA, req)
+				if len(ua.rrs) == 0 {
+					continue
+				}
+				h.updateRecords(name, dns.TypeA, ua)
+				mu.Lock()
+				resolved++
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, d := range domains {
+		names <- dns.Fqdn(strings.ToLower(d))
+	}
+	close(names)
+	wg.Wait()
+	log.Printf("Warmed up %d of %d domains in %s", resolved, len(domains), time.Since(start))
+}